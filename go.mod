@@ -10,6 +10,9 @@ replace (
 require (
 	github.com/aoscloud/aos_common v0.0.0-20220325093049-4f45745ecaa0
 	github.com/aoscloud/aos_updatemanager v0.0.0-20220509091056-837ad2f00a86
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/klauspost/compress v1.13.6
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/syucream/posix_mq v0.0.1
 )
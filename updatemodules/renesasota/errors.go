@@ -0,0 +1,203 @@
+package renesasota
+
+import (
+	"errors"
+
+	"github.com/aoscloud/aos_common/aoserrors"
+)
+
+/***********************************************************************************************************************
+ * Consts
+ **********************************************************************************************************************/
+
+// Reason codes.
+const (
+	// ReasonQueueUnavailable OTA master message queue can't be opened or used.
+	ReasonQueueUnavailable = "QUEUE_UNAVAILABLE"
+	// ReasonTimeout OTA master didn't respond in time.
+	ReasonTimeout = "TIMEOUT"
+	// ReasonBackpressure OTA master queue is full.
+	ReasonBackpressure = "BACKPRESSURE"
+	// ReasonMasterBusy OTA master is busy.
+	ReasonMasterBusy = "MASTER_BUSY"
+	// ReasonMasterFailed OTA master failed to execute command.
+	ReasonMasterFailed = "MASTER_FAILED"
+	// ReasonUnsupported operation is not supported by the module or OTA master.
+	ReasonUnsupported = "UNSUPPORTED"
+	// ReasonChecksumMismatch image verification failed.
+	ReasonChecksumMismatch = "CHECKSUM_MISMATCH"
+	// ReasonSignatureInvalid OTA master rejected image signature.
+	ReasonSignatureInvalid = "SIGNATURE_INVALID"
+	// ReasonValidationFailed OTA master rejected staged image before download.
+	ReasonValidationFailed = "VALIDATION_FAILED"
+	// ReasonDowngradeRejected OTA master rejected downgrade.
+	ReasonDowngradeRejected = "DOWNGRADE_REJECTED"
+	// ReasonProtocolError OTA master response is malformed.
+	ReasonProtocolError = "PROTOCOL_ERROR"
+	// ReasonInsufficientSpace not enough space to store image.
+	ReasonInsufficientSpace = "INSUFFICIENT_SPACE"
+	// ReasonExtractFailed image can't be extracted to the target file.
+	ReasonExtractFailed = "EXTRACT_FAILED"
+	// ReasonArchiveCorrupted image archive is corrupted and should be fetched again.
+	ReasonArchiveCorrupted = "ARCHIVE_CORRUPTED"
+	// ReasonIOError read or write error during image extraction.
+	ReasonIOError = "IO_ERROR"
+	// ReasonStorageFailed module state can't be stored.
+	ReasonStorageFailed = "STORAGE_FAILED"
+	// ReasonChunkCorrupted OTA master rejected uploaded chunk.
+	ReasonChunkCorrupted = "CHUNK_CORRUPTED"
+	// ReasonCommandLost OTA master didn't process all sent commands.
+	ReasonCommandLost = "COMMAND_LOST"
+	// ReasonOverheated device temperature is too high to update.
+	ReasonOverheated = "OVERHEATED"
+	// ReasonVersionNotAllowed vendor version is not in allowed versions list.
+	ReasonVersionNotAllowed = "VERSION_NOT_ALLOWED"
+	// ReasonMasterBacklogged OTA master has too many queued updates.
+	ReasonMasterBacklogged = "MASTER_BACKLOGGED"
+	// ReasonVersionMismatch OTA master active version doesn't match the expected one.
+	ReasonVersionMismatch = "VERSION_MISMATCH"
+	// ReasonMasterNotReady OTA master is not ready to install downloaded image.
+	ReasonMasterNotReady = "MASTER_NOT_READY"
+	// ReasonTargetInUse target file is used by OTA master.
+	ReasonTargetInUse = "TARGET_IN_USE"
+	// ReasonWriteBudgetExceeded daily write budget exceeded.
+	ReasonWriteBudgetExceeded = "WRITE_BUDGET_EXCEEDED"
+	// ReasonFetchFailed remote image can't be fetched.
+	ReasonFetchFailed = "FETCH_FAILED"
+	// ReasonFlashError OTA master failed to write image to flash.
+	ReasonFlashError = "FLASH_ERROR"
+	// ReasonVersionUnsupported OTA master doesn't support image version.
+	ReasonVersionUnsupported = "VERSION_UNSUPPORTED"
+)
+
+/***********************************************************************************************************************
+ * Vars
+ **********************************************************************************************************************/
+
+// Errors returned by the module.
+var (
+	ErrTimeout             = errors.New("OTA master response timeout")
+	ErrBusy                = errors.New("OTA master busy")
+	ErrBackpressure        = errors.New("OTA master queue full")
+	ErrVerificationFailed  = errors.New("image verification failed")
+	ErrDowngradeRejected   = errors.New("downgrade rejected")
+	ErrUnsupported         = errors.New("not supported")
+	ErrChunkCorrupted      = errors.New("chunk corrupted")
+	ErrCommandLost         = errors.New("OTA master command lost")
+	ErrOverheated          = errors.New("device overheated")
+	ErrMasterBacklogged    = errors.New("OTA master backlogged")
+	ErrNothingToApply      = errors.New("nothing to apply")
+	ErrTargetInUse         = errors.New("target file in use")
+	ErrWriteBudgetExceeded = errors.New("daily write budget exceeded")
+	ErrModuleClosed        = errors.New("module closed")
+	ErrRebootNotConfirmed  = errors.New("reboot not confirmed")
+	ErrFlashFailed         = errors.New("OTA master flash write failed")
+	ErrVersionUnsupported  = errors.New("version not supported by OTA master")
+)
+
+/***********************************************************************************************************************
+ * Types
+ **********************************************************************************************************************/
+
+// ReasonError module error with machine-readable reason code.
+type ReasonError struct {
+	code string
+	err  error
+}
+
+// TargetStatus extraction and verification status of target file.
+type TargetStatus struct {
+	File string
+	// Err is nil if the file is extracted and verified successfully.
+	Err error
+}
+
+// TargetsError error of target files extraction or verification. Targets contains status of each target file, so the
+// orchestrator can report which files succeeded even though the whole prepare is aborted.
+type TargetsError struct {
+	Targets []TargetStatus
+	err     error
+}
+
+/***********************************************************************************************************************
+ * Public
+ **********************************************************************************************************************/
+
+// IsRetryable returns true if the operation failed with err may be retried by the orchestrator.
+//
+// Classification:
+//
+//	ErrTimeout            retryable
+//	ErrBusy               retryable
+//	ErrBackpressure       retryable
+//	ErrChunkCorrupted     retryable
+//	ErrCommandLost        retryable
+//	ErrOverheated         retryable
+//	ErrMasterBacklogged   retryable
+//	ErrTargetInUse        retryable
+//	ErrVerificationFailed fatal
+//	ErrDowngradeRejected  fatal
+//	ErrUnsupported        fatal
+//	ErrFlashFailed        fatal
+//	ErrVersionUnsupported fatal
+//	any other error       fatal
+func IsRetryable(err error) bool {
+	for _, retryableErr := range []error{
+		ErrTimeout, ErrBusy, ErrBackpressure, ErrChunkCorrupted, ErrCommandLost, ErrOverheated, ErrMasterBacklogged,
+		ErrTargetInUse,
+	} {
+		if errors.Is(err, retryableErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrorCode returns reason code of err or empty string if err has no reason code.
+func ErrorCode(err error) string {
+	var reasonErr *ReasonError
+
+	if errors.As(err, &reasonErr) {
+		return reasonErr.Code()
+	}
+
+	return ""
+}
+
+// Error returns error message.
+func (reasonErr *ReasonError) Error() string {
+	return reasonErr.err.Error()
+}
+
+// Unwrap unwraps error.
+func (reasonErr *ReasonError) Unwrap() error {
+	return reasonErr.err
+}
+
+// Code returns reason code.
+func (reasonErr *ReasonError) Code() string {
+	return reasonErr.code
+}
+
+// Error returns error message.
+func (targetsErr *TargetsError) Error() string {
+	return targetsErr.err.Error()
+}
+
+// Unwrap unwraps error.
+func (targetsErr *TargetsError) Unwrap() error {
+	return targetsErr.err
+}
+
+/***********************************************************************************************************************
+ * Private
+ **********************************************************************************************************************/
+
+func newReasonError(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &ReasonError{code: code, err: aoserrors.Wrap(err)}
+}
@@ -0,0 +1,111 @@
+package renesasota
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aoscloud/aos_common/aoserrors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/***********************************************************************************************************************
+ * Consts
+ **********************************************************************************************************************/
+
+const metricsNamespace = "renesasota"
+
+/***********************************************************************************************************************
+ * Types
+ **********************************************************************************************************************/
+
+// PrometheusMetrics is Metrics implementation which exposes module metrics as Prometheus collectors: counters of
+// commands sent, succeeded and failed, command latency histogram and state gauge. The state gauge is 1 for the
+// current state of the module and 0 for its previous states.
+type PrometheusMetrics struct {
+	sync.Mutex
+
+	commandsSent      *prometheus.CounterVec
+	commandsSucceeded *prometheus.CounterVec
+	commandsFailed    *prometheus.CounterVec
+	commandLatency    *prometheus.HistogramVec
+	state             *prometheus.GaugeVec
+	currentStates     map[string]string
+}
+
+/***********************************************************************************************************************
+ * Public
+ **********************************************************************************************************************/
+
+// NewPrometheusMetrics creates Prometheus metrics and registers them on the registerer. The metrics are shared by
+// modules and labeled by module ID, so one instance should be created per registerer.
+func NewPrometheusMetrics(registerer prometheus.Registerer) (metrics *PrometheusMetrics, err error) {
+	metrics = &PrometheusMetrics{
+		commandsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_sent_total",
+			Help:      "Number of OTA master commands sent.",
+		}, []string{"module", "command"}),
+		commandsSucceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_succeeded_total",
+			Help:      "Number of OTA master commands succeeded.",
+		}, []string{"module", "command"}),
+		commandsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_failed_total",
+			Help:      "Number of OTA master commands failed.",
+		}, []string{"module", "command"}),
+		commandLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_latency_seconds",
+			Help:      "OTA master command latency.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"module", "command"}),
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "state",
+			Help:      "Update module state.",
+		}, []string{"module", "state"}),
+		currentStates: make(map[string]string),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		metrics.commandsSent, metrics.commandsSucceeded, metrics.commandsFailed, metrics.commandLatency, metrics.state,
+	} {
+		if err = registerer.Register(collector); err != nil {
+			return nil, aoserrors.Wrap(err)
+		}
+	}
+
+	return metrics, nil
+}
+
+// CommandSent counts sent command.
+func (metrics *PrometheusMetrics) CommandSent(moduleID, command string) {
+	metrics.commandsSent.WithLabelValues(moduleID, command).Inc()
+}
+
+// CommandSucceeded counts succeeded command and observes its latency.
+func (metrics *PrometheusMetrics) CommandSucceeded(moduleID, command string, latency time.Duration) {
+	metrics.commandsSucceeded.WithLabelValues(moduleID, command).Inc()
+	metrics.commandLatency.WithLabelValues(moduleID, command).Observe(latency.Seconds())
+}
+
+// CommandFailed counts failed command and observes its latency.
+func (metrics *PrometheusMetrics) CommandFailed(moduleID, command string, latency time.Duration) {
+	metrics.commandsFailed.WithLabelValues(moduleID, command).Inc()
+	metrics.commandLatency.WithLabelValues(moduleID, command).Observe(latency.Seconds())
+}
+
+// StateChanged sets the state gauge of the new module state and resets the gauge of the previous one.
+func (metrics *PrometheusMetrics) StateChanged(moduleID, state string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if previous, ok := metrics.currentStates[moduleID]; ok {
+		metrics.state.WithLabelValues(moduleID, previous).Set(0)
+	}
+
+	metrics.state.WithLabelValues(moduleID, state).Set(1)
+	metrics.currentStates[moduleID] = state
+}
@@ -1,17 +1,41 @@
 package renesasota
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aoscloud/aos_common/aoserrors"
 	"github.com/aoscloud/aos_common/aostypes"
 	"github.com/aoscloud/aos_common/partition"
 	"github.com/aoscloud/aos_updatemanager/updatehandler"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
 	"github.com/syucream/posix_mq"
 )
@@ -21,49 +45,547 @@ import (
  **********************************************************************************************************************/
 
 const (
-	otaCommandSyncCompose = 0
-	otaCommandDownload    = 1
-	otaCommandInstall     = 2
-	otaCommandActivate    = 3
-	otaCommandRevert      = 4
+	otaCommandSyncCompose      = 0
+	otaCommandDownload         = 1
+	otaCommandInstall          = 2
+	otaCommandActivate         = 3
+	otaCommandRevert           = 4
+	otaCommandGetMasterVersion = 5
+	otaCommandGetCapabilities  = 6
+	otaCommandGetFreeSpace     = 7
+	otaCommandUptime           = 8
+	otaCommandUploadChunk      = 9
+	otaCommandSetBootLimit     = 10
+	otaCommandNegotiate        = 11
+	otaCommandFlush            = 12
+	otaCommandVerifySignature  = 13
+	otaCommandGetCommandCount  = 14
+	otaCommandDiscard          = 15
+	otaCommandGetThermalState  = 16
+	otaCommandGetQueueDepth    = 17
+	otaCommandGetActiveVersion = 18
+	otaCommandValidate         = 19
+	otaCommandGetMasterState   = 20
+	otaCommandGetRebootSafety  = 21
+	otaCommandGetFingerprint   = 22
+	otaCommandPreallocate      = 23
+	otaCommandGetLastGood      = 24
+	otaCommandVerifyChunk      = 25
+	otaCommandSetVerbose       = 26
+	otaCommandBeginTxn         = 27
+	otaCommandCommitTxn        = 28
+	otaCommandRollbackTxn      = 29
+	otaCommandGetQueueCapacity = 30
+	otaCommandGetMasterConfig  = 31
+	otaCommandReboot           = 32
+	otaCommandPreservePrevious = 33
+	otaCommandGetComponents    = 34
+	otaCommandPurge            = 35
+	otaCommandGetChunkSize     = 36
+	otaCommandSetDeadline      = 37
 )
 
+// OTA master update states reported by otaCommandGetMasterState.
 const (
-	otaStatusSuccess = 0
-	otaStatusFailed  = 1
+	otaMasterStateIdle      = 0
+	otaMasterStateReady     = 1
+	otaMasterStateInstalled = 2
+	otaMasterStateActivated = 3
+)
+
+// Timed phases.
+const phaseExtract = "extract"
+
+// Command sequence names.
+const (
+	sequencePrepare = "prepare"
+	sequenceUpdate  = "update"
+	sequenceRevert  = "revert"
+)
+
+const (
+	otaStatusSuccess            = 0
+	otaStatusFailed             = 1
+	otaStatusBusy               = 2
+	otaStatusUnsupported        = 3
+	otaStatusVerificationFailed = 4
+	otaStatusDowngradeRejected  = 5
+	otaStatusChunkCorrupted     = 6
+	otaStatusNoSpace            = 7
+	otaStatusProgress           = 8
+	otaStatusFlashError         = 9
+	otaStatusVersionUnsupported = 10
 )
 
 const otaDefaultTimeout = 10 * time.Minute
 
+const otaChunkMaxRetries = 3
+
+const otaCancelPollInterval = 100 * time.Millisecond
+
+// statusSchemaVersion version of StatusJSON document schema. It is incremented on incompatible schema changes.
+const statusSchemaVersion = 1
+
+const (
+	otaDefaultMaxRetries = 3
+	otaRetryDelay        = 10 * time.Millisecond
+)
+
+const (
+	otaDefaultQueueOpenTimeout = 30 * time.Second
+	otaMaxPrepareRestarts      = 3
+)
+
+// Policies of handling unknown OTA master statuses.
+const (
+	unknownStatusFail    = "fail"
+	unknownStatusSuccess = "treat-as-success"
+	unknownStatusBusy    = "treat-as-busy-retry"
+)
+
+// Protocol byte orders.
+const (
+	byteOrderLittle = "little"
+	byteOrderBig    = "big"
+)
+
+// Image compression formats.
+const (
+	compressionGzip = "gzip"
+	compressionXZ   = "xz"
+	compressionZstd = "zstd"
+	compressionNone = "none"
+)
+
+const (
+	otaProtocolV1      = 1
+	otaDefaultProtocol = otaProtocolV1
+)
+
+const (
+	stateFormatJSON = "json"
+	stateFormatCBOR = "cbor"
+	stateFormatGob  = "gob"
+)
+
+// Vendor version schemes.
+const (
+	versionSchemeSemver = "semver"
+	versionSchemeNone   = "none"
+)
+
+// stateGobMagic prefixes gob encoded state. JSON state always starts with '{', so the format of persisted state is
+// detected on load regardless of configured StateFormat.
+const stateGobMagic = 0x01
+
+// stateCBORMagic is CBOR self-described tag (RFC 8949, section 3.4.6) which prefixes CBOR encoded state.
+var stateCBORMagic = []byte{0xd9, 0xd9, 0xf7}
+
+// Progress phases.
+const (
+	ProgressPhaseExtract  = "extract"
+	ProgressPhaseDownload = "download"
+	ProgressPhaseVerify   = "verify"
+	ProgressPhaseInstall  = "install"
+	ProgressPhaseActivate = "activate"
+	ProgressPhaseDone     = "done"
+)
+
+const progressChannelSize = 16
+
+// Event types.
+const (
+	EventStateChanged        = "stateChanged"
+	EventCommandSent         = "commandSent"
+	EventCommandProgress     = "commandProgress"
+	EventCommandAcknowledged = "commandAcknowledged"
+)
+
+const readyDefaultCacheTTL = 5 * time.Second
+
+const remoteImageDefaultTimeout = 10 * time.Minute
+
+const orphanDefaultMaxAge = time.Hour
+
 const (
 	idleState = iota
 	preparedState
 	updatedState
+	// failedState update failed after the master acknowledged part of the update commands: the master may have
+	// partially installed image and the module should be reverted.
+	failedState
+)
+
+/***********************************************************************************************************************
+ * Vars
+ **********************************************************************************************************************/
+
+var otaSupportedProtocols = []uint32{otaProtocolV1}
+
+// semverRegexp matches semantic version 2.0.0 (https://semver.org).
+var semverRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+// compressionMagics maps image compression formats to their magic bytes.
+var compressionMagics = map[string][]byte{
+	compressionGzip: {0x1f, 0x8b},
+	compressionXZ:   {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+	compressionZstd: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+var (
+	extractionMutex     sync.Mutex
+	extractionSemaphore chan struct{}
 )
 
+// otaCommandNames maps command names used in configuration to OTA master commands.
+var otaCommandNames = map[string]int64{
+	"syncCompose":      otaCommandSyncCompose,
+	"download":         otaCommandDownload,
+	"install":          otaCommandInstall,
+	"activate":         otaCommandActivate,
+	"revert":           otaCommandRevert,
+	"getMasterVersion": otaCommandGetMasterVersion,
+	"getCapabilities":  otaCommandGetCapabilities,
+	"getFreeSpace":     otaCommandGetFreeSpace,
+	"uptime":           otaCommandUptime,
+	"uploadChunk":      otaCommandUploadChunk,
+	"setBootLimit":     otaCommandSetBootLimit,
+	"negotiate":        otaCommandNegotiate,
+	"flush":            otaCommandFlush,
+	"verifySignature":  otaCommandVerifySignature,
+	"getCommandCount":  otaCommandGetCommandCount,
+	"discard":          otaCommandDiscard,
+	"getThermalState":  otaCommandGetThermalState,
+	"getQueueDepth":    otaCommandGetQueueDepth,
+	"getActiveVersion": otaCommandGetActiveVersion,
+	"validate":         otaCommandValidate,
+	"getMasterState":   otaCommandGetMasterState,
+	"getRebootSafety":  otaCommandGetRebootSafety,
+	"getFingerprint":   otaCommandGetFingerprint,
+	"preallocate":      otaCommandPreallocate,
+	"getLastGood":      otaCommandGetLastGood,
+	"verifyChunk":      otaCommandVerifyChunk,
+	"setVerbose":       otaCommandSetVerbose,
+	"beginTxn":         otaCommandBeginTxn,
+	"commitTxn":        otaCommandCommitTxn,
+	"rollbackTxn":      otaCommandRollbackTxn,
+	"getQueueCapacity": otaCommandGetQueueCapacity,
+	"getMasterConfig":  otaCommandGetMasterConfig,
+	"reboot":           otaCommandReboot,
+	"preservePrevious": otaCommandPreservePrevious,
+	"getComponents":    otaCommandGetComponents,
+	"purge":            otaCommandPurge,
+	"getChunkSize":     otaCommandGetChunkSize,
+	"setDeadline":      otaCommandSetDeadline,
+}
+
 /***********************************************************************************************************************
  * Types
  **********************************************************************************************************************/
 
 // RenesasUpdateModule update components using Renesas OTA master.
 type RenesasUpdateModule struct {
-	id             string
-	config         moduleConfig
-	storage        updatehandler.ModuleStorage
-	State          updateState `json:"state"`
-	VendorVersion  string      `json:"vendorVersion"`
-	PendingVersion string      `json:"pendingVersion"`
+	id          string
+	config      moduleConfig
+	sequences   map[string][]int64
+	storage     updatehandler.ModuleStorage
+	clock       Clock
+	protocol    int
+	fingerprint string
+	lastCommand time.Time
+	validator   ResponseValidator
+	events      EventHandler
+	metrics     Metrics
+	ready       bool
+	readyAt     time.Time
+	stats       ProtocolStats
+
+	chunkVerifyUnsupported bool
+	rebootRequired         bool
+	batchAcknowledged      int
+	chunkSize              int
+	lastResult             *operationStatus
+	stateDirty             bool
+	stateWrittenAt         time.Time
+
+	byteOrder binary.ByteOrder
+	cleanups  []func()
+
+	// stateMutex guards persisted module state (all exported fields), protocol stats, last command time, reboot
+	// required flag, cached fingerprint, Ready cache and state persistence (stateDirty, stateWrittenAt). It is never
+	// held while waiting for OTA master response, so state getters are not blocked by running operation.
+	stateMutex sync.Mutex
+
+	// ipcMutex serializes OTA master IPC: it is held for each request/response pair and for a whole command batch, so
+	// concurrent callers never take each other's responses. It is acquired before stateMutex, never the other way.
+	ipcMutex sync.Mutex
+
+	queueMutex sync.Mutex
+	sendMQ     *posix_mq.MessageQueue
+	recvMQ     *posix_mq.MessageQueue
+
+	commandMutex    sync.Mutex
+	commandDeadline time.Time
+	commandInFlight int64
+
+	progressMutex   sync.Mutex
+	progressChannel chan ProgressEvent
+
+	operationMutex   sync.Mutex
+	ctx              context.Context
+	operationID      string
+	operationCount   uint64
+	sessionStart     time.Time
+	operations       []*operation
+	runningOperation *operation
+	operationNotify  chan struct{}
+	workerDone       chan struct{}
+	closed           bool
+
+	State             updateState              `json:"state"`
+	VendorVersion     string                   `json:"vendorVersion"`
+	PendingVersion    string                   `json:"pendingVersion"`
+	UploadedChunks    uint32                   `json:"uploadedChunks,omitempty"`
+	ChunkSize         int                      `json:"chunkSize,omitempty"`
+	PreparedAt        time.Time                `json:"preparedAt"`
+	UpdateCount       int                      `json:"updateCount"`
+	LastImagePath     string                   `json:"lastImagePath"`
+	PhaseTimings      map[string]time.Duration `json:"phaseTimings,omitempty"`
+	WrittenBytes      uint64                   `json:"writtenBytes,omitempty"`
+	WriteDayStart     time.Time                `json:"writeDayStart"`
+	Stats             *ProtocolStats           `json:"stats,omitempty"`
+	TxnOpen           bool                     `json:"txnOpen,omitempty"`
+	RebootRequestedAt time.Time                `json:"rebootRequestedAt"`
+	ExtractedImage    *extractedImage          `json:"extractedImage,omitempty"`
+	TargetOverride    string                   `json:"targetOverride,omitempty"`
 }
 
 type moduleConfig struct {
-	SendQueueName    string            `json:"sendQueueName"`
-	ReceiveQueueName string            `json:"receiveQueueName"`
-	TargetFile       string            `json:"targetFile"`
-	Timeout          aostypes.Duration `json:"timeout"`
+	SendQueueName             string                       `json:"sendQueueName"`
+	ReceiveQueueName          string                       `json:"receiveQueueName"`
+	TargetFile                string                       `json:"-"`
+	TargetFiles               targetFiles                  `json:"targetFile"`
+	TargetBaseDir             string                       `json:"targetBaseDir"`
+	SlotTargetFiles           map[string]string            `json:"slotTargetFiles"`
+	Timeout                   aostypes.Duration            `json:"timeout"`
+	ProbeBeforeUpdate         bool                         `json:"probeBeforeUpdate"`
+	StateHMACKey              string                       `json:"stateHmacKey"`
+	StrictStateIntegrity      bool                         `json:"strictStateIntegrity"`
+	UploadChunkSize           int                          `json:"uploadChunkSize"`
+	BootAttemptLimit          int                          `json:"bootAttemptLimit"`
+	NegotiateProtocol         bool                         `json:"negotiateProtocol"`
+	FlushAfterInstall         bool                         `json:"flushAfterInstall"`
+	StorageRetries            int                          `json:"storageRetries"`
+	StorageRetryDelay         aostypes.Duration            `json:"storageRetryDelay"`
+	StateFormat               string                       `json:"stateFormat"`
+	MasterVerifiesSignature   bool                         `json:"masterVerifiesSignature"`
+	ReconcileBatchCount       bool                         `json:"reconcileBatchCount"`
+	CleanupOnRevert           bool                         `json:"cleanupOnRevert"`
+	MaxUpdateTemperature      float64                      `json:"maxUpdateTemperature"`
+	AllowedVersions           []string                     `json:"allowedVersions"`
+	CommandTimeouts           map[string]aostypes.Duration `json:"commandTimeouts"`
+	CleanupOrphansOnStart     bool                         `json:"cleanupOrphansOnStart"`
+	OrphanMaxAge              aostypes.Duration            `json:"orphanMaxAge"`
+	MaxMasterQueueDepth       int                          `json:"maxMasterQueueDepth"`
+	ConfirmActiveVersion      bool                         `json:"confirmActiveVersion"`
+	ValidateBeforeDownload    bool                         `json:"validateBeforeDownload"`
+	Sequences                 map[string][]string          `json:"sequences"`
+	StrictApply               bool                         `json:"strictApply"`
+	VerifyPreparedOnMaster    bool                         `json:"verifyPreparedOnMaster"`
+	GuardActiveTarget         bool                         `json:"guardActiveTarget"`
+	PreallocateOnMaster       bool                         `json:"preallocateOnMaster"`
+	ReconcileOnInit           bool                         `json:"reconcileOnInit"`
+	DailyWriteBudget          uint64                       `json:"dailyWriteBudget"`
+	ReadyCacheTTL             aostypes.Duration            `json:"readyCacheTtl"`
+	StrictVersioning          bool                         `json:"strictVersioning"`
+	SerializeOperations       bool                         `json:"serializeOperations"`
+	AllowRemoteImages         bool                         `json:"allowRemoteImages"`
+	RemoteImageTimeout        aostypes.Duration            `json:"remoteImageTimeout"`
+	PersistStats              bool                         `json:"persistStats"`
+	VerifyEachChunk           bool                         `json:"verifyEachChunk"`
+	WorkDir                   string                       `json:"workDir"`
+	MasterVerboseDuringUpdate bool                         `json:"masterVerboseDuringUpdate"`
+	MinMasterProtocol         int                          `json:"minMasterProtocol"`
+	MaxMasterProtocol         int                          `json:"maxMasterProtocol"`
+	AutoDetectCompression     bool                         `json:"autoDetectCompression"`
+	ByteOrder                 string                       `json:"byteOrder"`
+	UseMasterTransaction      bool                         `json:"useMasterTransaction"`
+	UnknownStatusPolicy       string                       `json:"unknownStatusPolicy"`
+	Compression               string                       `json:"compression"`
+	CheckMasterConfig         bool                         `json:"checkMasterConfig"`
+	MaxRetries                int                          `json:"maxRetries"`
+	RetryOnChecksumMismatch   int                          `json:"retryOnChecksumMismatch"`
+	RebootCommand             string                       `json:"rebootCommand"`
+	RebootTimeout             aostypes.Duration            `json:"rebootTimeout"`
+	PreservePreviousSlot      bool                         `json:"preservePreviousSlot"`
+	StateWriteDebounce        aostypes.Duration            `json:"stateWriteDebounce"`
+	QueueMaxMsg               int                          `json:"queueMaxMsg"`
+	QueueMsgSize              int                          `json:"queueMsgSize"`
+	ConfirmReboot             bool                         `json:"confirmReboot"`
+	FailUnconfirmedReboot     bool                         `json:"failUnconfirmedReboot"`
+	CreateQueues              bool                         `json:"createQueues"`
+	AllowPurge                bool                         `json:"allowPurge"`
+	DiagnoseQueues            bool                         `json:"diagnoseQueues"`
+	NegotiateChunkSize        bool                         `json:"negotiateChunkSize"`
+	CleanupTargetOnApply      bool                         `json:"cleanupTargetOnApply"`
+	LiveVendorVersion         bool                         `json:"liveVendorVersion"`
+	MasterDeadline            aostypes.Duration            `json:"masterDeadline"`
+	VersionScheme             string                       `json:"versionScheme"`
+	RetryPrepareOnDisconnect  bool                         `json:"retryPrepareOnDisconnect"`
+	QueueOpenTimeout          aostypes.Duration            `json:"queueOpenTimeout"`
+	RollbackOnPartialFailure  bool                         `json:"rollbackOnPartialFailure"`
+}
+
+// targetFiles list of target files. It is unmarshaled from a single file name as well for backward compatibility. The
+// first file is the primary target: it is used by features which support a single target only.
+type targetFiles []string
+
+// prepareAnnotations image annotations. Checksums contains expected SHA256 hex checksum per target file path.
+// Target files without checksum are not verified. IgnoreWriteBudget allows to prepare the image even if daily write
+// budget is exceeded. ImageChecksum contains expected SHA256 hex checksum of remote image. SHA256 and Size contain
+// expected SHA256 hex checksum and size of the extracted image (TargetFile), they are not verified if empty.
+// TargetFile and Slot override the configured target file (see resolveTargetOverride).
+type prepareAnnotations struct {
+	Checksums         map[string]string `json:"checksums"`
+	IgnoreWriteBudget bool              `json:"ignoreWriteBudget"`
+	ImageChecksum     string            `json:"imageChecksum"`
+	SHA256            string            `json:"sha256"`
+	Size              int64             `json:"size"`
+	TargetFile        string            `json:"targetFile"`
+	Slot              string            `json:"slot"`
+}
+
+// extractedImage identifies image extracted to the target file by prepare which hasn't completed yet. SHA256 is hex
+// checksum of the target file.
+type extractedImage struct {
+	Source  string `json:"source"`
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+	// Targets contains checksums of target files extracted for multiple targets.
+	Targets map[string]string `json:"targets,omitempty"`
+}
+
+type signedState struct {
+	State json.RawMessage `json:"state"`
+	HMAC  string          `json:"hmac"`
 }
 
 type updateState int
 
+// Clock provides time source for the module.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+// ThermalState OTA master thermal state.
+type ThermalState struct {
+	// Temperature in degrees Celsius.
+	Temperature float64
+	// Throttled is set if the master throttles flash writes due to temperature.
+	Throttled bool
+}
+
+// ResponseValidator interprets raw OTA master response of the command with the given configuration name. It returns
+// success if the command is executed successfully. Non nil error fails the command regardless of success. The
+// validator is called synchronously from the module operation which sent the command, the module doesn't send other
+// commands until it returns, and it must not call the module methods.
+type ResponseValidator func(command string, recvData []byte) (success bool, err error)
+
+type operation struct {
+	run    func() (rebootRequired bool, err error)
+	result chan operationResult
+}
+
+type operationResult struct {
+	rebootRequired bool
+	err            error
+}
+
+// ProtocolStats OTA master protocol statistics. Counters are accumulated over the module lifetime and never reset.
+// If PersistStats is set, counters are saved with module state and survive restarts, otherwise they start from zero
+// on module creation.
+type ProtocolStats struct {
+	// CommandsSent number of commands successfully sent to the master.
+	CommandsSent uint64
+	// Failures number of commands failed for any reason including timeouts and failure statuses.
+	Failures uint64
+	// Timeouts number of commands failed due to send or receive timeout.
+	Timeouts uint64
+	// Retries number of commands resent after recoverable failure (e.g. corrupted chunk).
+	Retries uint64
+	// BytesTransferred total size of sent requests and received responses including frame headers.
+	BytesTransferred uint64
+}
+
+// ProgressEvent operation progress event.
+type ProgressEvent struct {
+	OperationID string
+	Phase       string
+	Percent     int
+	Timestamp   time.Time
+}
+
+// Event module state or OTA master command event. State is set for EventStateChanged, Command is set for command
+// events. Percent is set for EventCommandProgress. Err is set for EventCommandAcknowledged if the command failed.
+type Event struct {
+	ModuleID  string
+	Type      string
+	State     string
+	Command   string
+	Percent   int
+	Err       error
+	Timestamp time.Time
+}
+
+// EventHandler handles module events. The handler is called synchronously from the module operation, so it should
+// return quickly, and it must not call the module methods.
+type EventHandler func(event Event)
+
+// Metrics receives update metrics of the module: counters of OTA master commands sent, succeeded and failed,
+// command latency and current module state. PrometheusMetrics implements it with collectors registered on a Prometheus
+// registerer. Methods are called synchronously from the module operation and should return quickly.
+type Metrics interface {
+	CommandSent(moduleID, command string)
+	CommandSucceeded(moduleID, command string, latency time.Duration)
+	CommandFailed(moduleID, command string, latency time.Duration)
+	StateChanged(moduleID, state string)
+}
+
+type noopMetrics struct{}
+
+type statusDocument struct {
+	SchemaVersion  int              `json:"schemaVersion"`
+	ID             string           `json:"id"`
+	State          string           `json:"state"`
+	VendorVersion  string           `json:"vendorVersion"`
+	PendingVersion string           `json:"pendingVersion,omitempty"`
+	LastResult     *operationStatus `json:"lastResult,omitempty"`
+	PhaseTimingsMs map[string]int64 `json:"phaseTimingsMs,omitempty"`
+	RebootPending  bool             `json:"rebootPending"`
+	Stats          statusStats      `json:"stats"`
+}
+
+type operationStatus struct {
+	OperationID string    `json:"operationId"`
+	Success     bool      `json:"success"`
+	Reason      string    `json:"reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	FinishedAt  time.Time `json:"finishedAt"`
+}
+
+type statusStats struct {
+	CommandsSent     uint64 `json:"commandsSent"`
+	Failures         uint64 `json:"failures"`
+	Timeouts         uint64 `json:"timeouts"`
+	Retries          uint64 `json:"retries"`
+	BytesTransferred uint64 `json:"bytesTransferred"`
+}
+
 /***********************************************************************************************************************
  * Public
  **********************************************************************************************************************/
@@ -73,10 +595,24 @@ func New(id string, config json.RawMessage, storage updatehandler.ModuleStorage)
 	log.WithField("module", id).Debug("Create renesasupdate module")
 
 	module := &RenesasUpdateModule{
-		id:      id,
-		storage: storage,
+		id:           id,
+		storage:      storage,
+		clock:        realClock{},
+		metrics:      noopMetrics{},
+		protocol:     otaDefaultProtocol,
+		sessionStart: time.Now(),
 		config: moduleConfig{
-			Timeout: aostypes.Duration{Duration: otaDefaultTimeout},
+			Timeout:              aostypes.Duration{Duration: otaDefaultTimeout},
+			StateFormat:          stateFormatJSON,
+			VersionScheme:        versionSchemeSemver,
+			ByteOrder:            byteOrderLittle,
+			UnknownStatusPolicy:  unknownStatusFail,
+			MaxRetries:           otaDefaultMaxRetries,
+			CleanupTargetOnApply: true,
+			ReadyCacheTTL:        aostypes.Duration{Duration: readyDefaultCacheTTL},
+			RemoteImageTimeout:   aostypes.Duration{Duration: remoteImageDefaultTimeout},
+			QueueOpenTimeout:     aostypes.Duration{Duration: otaDefaultQueueOpenTimeout},
+			OrphanMaxAge:         aostypes.Duration{Duration: orphanDefaultMaxAge},
 		},
 	}
 
@@ -88,219 +624,4886 @@ func New(id string, config json.RawMessage, storage updatehandler.ModuleStorage)
 		return nil, aoserrors.New("receive and send message queue should be configured")
 	}
 
-	if module.config.TargetFile == "" {
-		return nil, aoserrors.New("target file name should be configured")
+	if len(module.config.TargetFiles) > 0 {
+		module.config.TargetFile = module.config.TargetFiles[0]
 	}
 
-	state, err := storage.GetModuleState(id)
-	if err != nil {
-		return nil, aoserrors.Wrap(err)
+	if err := module.checkTargetFiles(); err != nil {
+		return nil, err
 	}
 
-	if len(state) > 0 {
-		if err := json.Unmarshal(state, module); err != nil {
-			return nil, aoserrors.Wrap(err)
-		}
+	if module.config.WorkDir == "" {
+		module.config.WorkDir = filepath.Dir(module.config.TargetFile)
 	}
 
-	return module, nil
-}
-
-// Close closes DualPartModule.
-func (module *RenesasUpdateModule) Close() error {
-	log.WithFields(log.Fields{"id": module.id}).Debug("Close renesasupdate module")
-
-	return nil
-}
-
-// GetID returns module ID.
-func (module *RenesasUpdateModule) GetID() string {
-	return module.id
-}
-
-// Init initializes module.
-func (module *RenesasUpdateModule) Init() error {
-	return nil
-}
+	if err := checkWorkDir(module.config.WorkDir); err != nil {
+		return nil, err
+	}
 
-// GetVendorVersion returns vendor version.
-func (module *RenesasUpdateModule) GetVendorVersion() (string, error) {
-	return module.VendorVersion, nil
-}
+	switch module.config.ByteOrder {
+	case byteOrderLittle:
+		module.byteOrder = binary.LittleEndian
 
-// Prepare preparing image.
-func (module *RenesasUpdateModule) Prepare(imagePath string, vendorVersion string, annotations json.RawMessage) error {
-	log.WithFields(log.Fields{
-		"id":            module.id,
-		"imagePath":     imagePath,
-		"vendorVersion": vendorVersion,
-	}).Debug("Prepare renesasupdate module")
+	case byteOrderBig:
+		module.byteOrder = binary.BigEndian
 
-	if module.State == preparedState {
-		return nil
+	default:
+		return nil, aoserrors.Errorf("unsupported byte order: %s", module.config.ByteOrder)
 	}
 
-	if err := os.MkdirAll(filepath.Dir(module.config.TargetFile), 0o700); err != nil {
-		return aoserrors.Wrap(err)
+	if module.config.MaxRetries < 0 {
+		return nil, aoserrors.Errorf("wrong max retries: %d", module.config.MaxRetries)
 	}
 
-	file, err := os.Create(module.config.TargetFile)
-	if err != nil {
-		return aoserrors.Wrap(err)
+	if module.config.QueueMaxMsg < 0 || module.config.QueueMsgSize < 0 ||
+		(module.config.QueueMaxMsg == 0) != (module.config.QueueMsgSize == 0) {
+		return nil, aoserrors.Errorf("wrong queue attributes: max msg %d, msg size %d",
+			module.config.QueueMaxMsg, module.config.QueueMsgSize)
 	}
-	file.Close()
 
-	if _, err := partition.CopyFromGzipArchive(module.config.TargetFile, imagePath); err != nil {
-		return aoserrors.Wrap(err)
+	if module.config.RetryOnChecksumMismatch < 0 {
+		return nil, aoserrors.Errorf("wrong checksum mismatch retries: %d", module.config.RetryOnChecksumMismatch)
 	}
 
-	if err := module.sendOTACommands(otaCommandSyncCompose, otaCommandDownload); err != nil {
-		return err
+	switch module.config.Compression {
+	case "", compressionGzip, compressionZstd, compressionNone:
+
+	default:
+		return nil, aoserrors.Errorf("unsupported image compression: %s", module.config.Compression)
 	}
 
-	module.PendingVersion = vendorVersion
+	switch module.config.VersionScheme {
+	case versionSchemeSemver, versionSchemeNone:
 
-	if err := module.setState(preparedState); err != nil {
-		return err
+	default:
+		return nil, aoserrors.Errorf("unsupported version scheme: %s", module.config.VersionScheme)
 	}
 
-	return nil
-}
-
-// Update updates module.
-func (module *RenesasUpdateModule) Update() (rebootRequired bool, err error) {
-	log.WithFields(log.Fields{"id": module.id}).Debug("Update renesasupdate module")
+	switch module.config.UnknownStatusPolicy {
+	case unknownStatusFail, unknownStatusSuccess, unknownStatusBusy:
 
-	if module.State == updatedState {
-		return false, nil
+	default:
+		return nil, aoserrors.Errorf("unsupported unknown status policy: %s", module.config.UnknownStatusPolicy)
 	}
 
-	if err := module.sendOTACommands(otaCommandInstall, otaCommandActivate); err != nil {
-		return false, err
+	if module.config.StateFormat != stateFormatJSON && module.config.StateFormat != stateFormatCBOR &&
+		module.config.StateFormat != stateFormatGob {
+		return nil, aoserrors.Errorf("unsupported state format: %s", module.config.StateFormat)
 	}
 
-	module.VendorVersion, module.PendingVersion = module.PendingVersion, module.VendorVersion
+	for name, timeout := range module.config.CommandTimeouts {
+		if _, ok := otaCommandNames[name]; !ok {
+			return nil, aoserrors.Errorf("unknown command in timeouts: %s", name)
+		}
 
-	if err := module.setState(updatedState); err != nil {
-		return false, err
+		if timeout.Duration <= 0 {
+			return nil, aoserrors.Errorf("wrong %s command timeout: %v", name, timeout.Duration)
+		}
 	}
 
-	return false, nil
-}
-
-// Revert reverts update.
-func (module *RenesasUpdateModule) Revert() (rebootRequired bool, err error) {
-	log.WithFields(log.Fields{"id": module.id}).Debug("Revert renesasupdate module")
+	sequences, err := parseSequences(module.config.Sequences)
+	if err != nil {
+		return nil, err
+	}
 
-	if module.State == idleState {
-		return false, nil
+	if _, ok := sequences[sequencePrepare]; ok && module.config.UploadChunkSize > 0 {
+		return nil, aoserrors.New("prepare sequence is not supported with chunked upload")
 	}
 
-	if err := module.sendOTACommands(otaCommandRevert); err != nil {
-		return false, err
+	module.sequences = sequences
+
+	state, err := module.getModuleState()
+	if err != nil {
+		return nil, aoserrors.Wrap(err)
 	}
 
-	if module.State == updatedState {
-		module.VendorVersion, module.PendingVersion = module.PendingVersion, module.VendorVersion
+	if len(state) > 0 {
+		if err := module.loadState(state); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := module.setState(idleState); err != nil {
-		return false, err
+	if module.State == failedState {
+		module.logger().WithFields(log.Fields{
+			"pendingVersion": module.PendingVersion,
+		}).Warn("Previous update failed or was interrupted, module should be reverted")
 	}
 
-	return rebootRequired, nil
-}
+	if module.config.PersistStats && module.Stats != nil {
+		module.stats = *module.Stats
+	}
 
-// Apply applies update.
-func (module *RenesasUpdateModule) Apply() (rebootRequired bool, err error) {
-	log.WithFields(log.Fields{"id": module.id}).Debug("Apply renesasupdate module")
+	module.Stats = nil
 
-	if module.State == idleState {
-		return false, nil
+	if module.config.CleanupOrphansOnStart {
+		module.cleanupOrphans()
 	}
 
-	if err := module.setState(idleState); err != nil {
-		return false, err
+	if module.config.SerializeOperations {
+		module.operationNotify = make(chan struct{}, 1)
+		module.workerDone = make(chan struct{})
+
+		go module.processOperations()
 	}
 
-	return false, nil
+	return module, nil
 }
 
-// Reboot performs module reboot.
-func (module *RenesasUpdateModule) Reboot() error {
-	log.WithFields(log.Fields{"id": module.id}).Debugf("Reboot renesasupdate module")
+// SetClock sets time source used to compute OTA master request deadlines.
+func (module *RenesasUpdateModule) SetClock(clock Clock) {
+	module.clock = clock
+}
 
-	return aoserrors.New("not supported")
+// SetResponseValidator sets validator used instead of built-in int64 status parsing of OTA master responses. With
+// validator set, the whole response is passed to it and returned as command response payload. Nil validator restores
+// built-in parsing.
+func (module *RenesasUpdateModule) SetResponseValidator(validator ResponseValidator) {
+	module.validator = validator
 }
 
-func (state updateState) String() string {
-	return []string{"idle", "prepared", "updated"}[state]
+// SetEventHandler sets handler of module state changes and OTA master commands sent by update sequences. Nil handler
+// disables events.
+func (module *RenesasUpdateModule) SetEventHandler(handler EventHandler) {
+	module.events = handler
 }
 
-/***********************************************************************************************************************
- * Private
- **********************************************************************************************************************/
+// SetMetrics sets receiver of metrics of OTA master commands sent by update sequences and module state changes. Nil
+// metrics disables metrics.
+func (module *RenesasUpdateModule) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
 
-func (module *RenesasUpdateModule) setState(state updateState) error {
-	log.WithFields(log.Fields{"id": module.id, "state": state}).Debugf("State changed")
+	module.metrics = metrics
+}
 
-	module.State = state
+// Close closes DualPartModule. If operations are serialized, queued operations are canceled with ErrModuleClosed
+// and Close waits for the running operation to finish. Debounced module state is saved and OTA master queues are
+// closed.
+func (module *RenesasUpdateModule) Close() error {
+	module.logger().Debug("Close renesasupdate module")
 
-	data, err := json.Marshal(module)
-	if err != nil {
-		return aoserrors.Wrap(err)
+	if module.config.SerializeOperations {
+		module.cancelOperations()
 	}
 
-	if err = module.storage.SetModuleState(module.id, data); err != nil {
-		return aoserrors.Wrap(err)
-	}
+	module.disconnectQueues()
 
-	return nil
+	return module.flushState()
 }
 
-func (module *RenesasUpdateModule) sendOTACommands(commands ...int64) error {
-	sendMQ, err := posix_mq.NewMessageQueue(
-		module.config.SendQueueName, posix_mq.O_WRONLY, 0o600, nil)
-	if err != nil {
-		return aoserrors.Wrap(err)
-	}
-	defer sendMQ.Close()
+func (module *RenesasUpdateModule) cancelOperations() {
+	module.operationMutex.Lock()
 
-	recvMQ, err := posix_mq.NewMessageQueue(
-		module.config.ReceiveQueueName, posix_mq.O_RDONLY, 0o600, nil)
-	if err != nil {
-		return aoserrors.Wrap(err)
+	module.closed = true
+	canceled := module.operations
+	module.operations = nil
+
+	module.operationMutex.Unlock()
+
+	for _, op := range canceled {
+		op.result <- operationResult{err: aoserrors.Wrap(ErrModuleClosed)}
 	}
-	defer recvMQ.Close()
 
-	for _, command := range commands {
-		buffer := bytes.NewBuffer(nil)
+	module.notifyOperations()
 
-		if err = binary.Write(buffer, binary.LittleEndian, command); err != nil {
-			return aoserrors.Wrap(err)
-		}
+	<-module.workerDone
+}
 
-		if err = sendMQ.TimedSend(buffer.Bytes(), 0, time.Now().Add(module.config.Timeout.Duration)); err != nil {
-			return aoserrors.Wrap(err)
+// GetID returns module ID.
+func (module *RenesasUpdateModule) GetID() string {
+	return module.id
+}
+
+// Init initializes module.
+func (module *RenesasUpdateModule) Init() error {
+	if module.config.ConfirmReboot && !module.getRebootRequestedAt().IsZero() {
+		if err := module.confirmReboot(); err != nil {
+			return err
 		}
+	}
 
-		recvData, _, err := recvMQ.TimedReceive(time.Now().Add(module.config.Timeout.Duration))
-		if err != nil {
-			return aoserrors.Wrap(err)
+	if _, _, err := module.connectQueues(); err != nil {
+		if module.config.DiagnoseQueues {
+			module.diagnoseQueues()
 		}
 
-		buffer = bytes.NewBuffer(recvData)
+		return aoserrors.Errorf("can't open OTA master queues: %w", err)
+	}
 
-		var status int64
+	if module.config.NegotiateProtocol {
+		if err := module.negotiateProtocol(); err != nil {
+			return err
+		}
+	}
 
-		if err = binary.Read(buffer, binary.LittleEndian, &status); err != nil {
-			return aoserrors.Wrap(err)
+	if err := module.checkMasterProtocol(); err != nil {
+		return err
+	}
+
+	if module.config.ReconcileOnInit {
+		if err := module.reconcileState(); err != nil {
+			return err
 		}
 
-		if status != otaStatusSuccess {
-			return aoserrors.Errorf("execute command %d failed", command)
+		if err := module.reconcileVendorVersion(); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	if module.config.CheckMasterConfig {
+		module.checkMasterConfig()
+	}
+
+	return module.flushState()
+}
+
+// GetVendorVersion returns vendor version. By default, the version persisted in module state is returned. If
+// LiveVendorVersion is set, the version installed on OTA master is requested (see GetActiveVersion) and the persisted
+// version is updated if it differs, e.g. after out-of-band firmware change. The updated version is written to the state
+// storage by the next operation or on Close. If the master doesn't respond in time or doesn't report the active
+// version, the persisted version is returned.
+func (module *RenesasUpdateModule) GetVendorVersion() (string, error) {
+	if module.config.LiveVendorVersion {
+		return module.getLiveVendorVersion()
+	}
+
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.VendorVersion, nil
+}
+
+// Prepare preparing image.
+func (module *RenesasUpdateModule) Prepare(imagePath string, vendorVersion string, annotations json.RawMessage) error {
+	return module.PrepareWithContext(context.Background(), imagePath, vendorVersion, annotations)
+}
+
+// PrepareWithContext prepares image with cancellation support. When ctx is canceled, the module stops waiting for OTA
+// master response and returns error wrapping ctx.Err(). Commands already received by the master are not rolled back.
+//
+// If RetryPrepareOnDisconnect is set and OTA master disconnects during prepare (see isMasterDisconnected), the module
+// waits up to QueueOpenTimeout for the master queues to reappear and restarts prepare. The restarted prepare resumes
+// from the last persisted point: extracted image and uploaded chunks are not processed again. Prepare is restarted up
+// to otaMaxPrepareRestarts times, other failures are returned as is. Restarts share the same progress channel, it is
+// closed once when prepare finishes.
+func (module *RenesasUpdateModule) PrepareWithContext(
+	ctx context.Context, imagePath string, vendorVersion string, annotations json.RawMessage,
+) error {
+	_, err := module.runOperation(ctx, func() (bool, error) {
+		defer module.finishProgress()
+
+		for i := 0; ; i++ {
+			err := module.prepare(imagePath, vendorVersion, annotations)
+			if err == nil || !module.config.RetryPrepareOnDisconnect || i >= otaMaxPrepareRestarts ||
+				!module.isMasterDisconnected(err) {
+				return false, err
+			}
+
+			module.logger().WithFields(log.Fields{"attempt": i + 1}).Warnf("OTA master disconnected, restart prepare: %v", err)
+
+			if waitErr := module.waitQueues(); waitErr != nil {
+				module.logger().Errorf("OTA master queues are not available: %v", waitErr)
+
+				return false, err
+			}
+		}
+	})
+
+	return err
+}
+
+// Update updates module.
+func (module *RenesasUpdateModule) Update() (rebootRequired bool, err error) {
+	return module.UpdateWithContext(context.Background())
+}
+
+// UpdateWithContext updates module with cancellation support (see PrepareWithContext).
+func (module *RenesasUpdateModule) UpdateWithContext(ctx context.Context) (rebootRequired bool, err error) {
+	return module.runOperation(ctx, module.update)
+}
+
+// Revert reverts update.
+func (module *RenesasUpdateModule) Revert() (rebootRequired bool, err error) {
+	return module.RevertWithContext(context.Background())
+}
+
+// RevertWithContext reverts update with cancellation support (see PrepareWithContext).
+func (module *RenesasUpdateModule) RevertWithContext(ctx context.Context) (rebootRequired bool, err error) {
+	return module.runOperation(ctx, module.revert)
+}
+
+// Apply applies update. Only updated module can be applied: in prepared or failed state the update should be reverted
+// instead. If CleanupTargetOnApply is set (default), the target file is removed once the update is committed.
+func (module *RenesasUpdateModule) Apply() (rebootRequired bool, err error) {
+	return module.runOperation(context.Background(), module.apply)
+}
+
+// Reboot performs module reboot. If RebootCommand is configured, it is executed with sh -c as reboot hook, otherwise
+// otaCommandReboot is sent to OTA master. Both wait up to RebootTimeout (base Timeout if not set). Reboot returns nil
+// once the hook succeeded or the master acknowledged the command: the system may go down at any moment after that.
+//
+// If ConfirmReboot is set, the reboot request time is persisted before rebooting and the next Init checks that the
+// system has booted since then (see confirmReboot).
+func (module *RenesasUpdateModule) Reboot() error {
+	_, err := module.runOperation(context.Background(), func() (bool, error) {
+		return false, module.reboot()
+	})
+
+	return err
+}
+
+// PurgeMaster asks OTA master to abort any operation in progress and delete all staged and downloaded data, returning
+// the master to clean idle state. It is heavy-handed recovery when the master state is inconsistent. On success, the
+// module state is reset to idle and regular target files are removed. Any prepared or installed but not applied update
+// is discarded irreversibly and should be prepared again. The purge must be enabled with AllowPurge.
+func (module *RenesasUpdateModule) PurgeMaster() error {
+	module.logger().Debug("Purge OTA master")
+
+	if !module.config.AllowPurge {
+		return aoserrors.New("OTA master purge is not allowed")
+	}
+
+	_, err := module.runOperation(context.Background(), func() (bool, error) {
+		return false, module.purgeMaster()
+	})
+
+	return err
+}
+
+// CheckQueues checks that OTA master queues can be opened. The queues are opened anew regardless of the queues used
+// by the module. No messages are sent or received, so checks of different modules sharing the same queues don't
+// interfere with each other.
+func (module *RenesasUpdateModule) CheckQueues() error {
+	sendMQ, recvMQ, err := module.openOTAQueues()
+	if err != nil {
+		return err
+	}
+
+	sendMQ.Close()
+	recvMQ.Close()
+
+	return nil
+}
+
+// CurrentOperationID returns ID of the running operation (see runOperation) or empty string if no operation is
+// running. The ID is generated at the start of each operation as <module ID>-<session>-<operation number>, where
+// session is module creation time in hex Unix seconds and operation number is incremented for each operation of the
+// session. The ID is added to the operation log lines (operationId field) and progress events.
+func (module *RenesasUpdateModule) CurrentOperationID() string {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	return module.operationID
+}
+
+// PendingOperations returns number of queued and running operations (see runOperation). It is always zero if operations
+// are not serialized.
+func (module *RenesasUpdateModule) PendingOperations() int {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	pending := len(module.operations)
+
+	if module.runningOperation != nil {
+		pending++
+	}
+
+	return pending
+}
+
+// RemainingTimeout returns time left until the deadline of the OTA master command in flight or zero if no command is
+// in flight.
+func (module *RenesasUpdateModule) RemainingTimeout() time.Duration {
+	module.commandMutex.Lock()
+	defer module.commandMutex.Unlock()
+
+	if module.commandDeadline.IsZero() {
+		return 0
+	}
+
+	remaining := module.commandDeadline.Sub(module.clock.Now())
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// InFlightCommand returns name of the OTA master command being sent or awaiting response. If no command is in flight,
+// ok is false. A command staying in flight for long (see RemainingTimeout) points to the step the module is stuck on.
+func (module *RenesasUpdateModule) InFlightCommand() (command string, ok bool) {
+	module.commandMutex.Lock()
+	defer module.commandMutex.Unlock()
+
+	if module.commandDeadline.IsZero() {
+		return "", false
+	}
+
+	return commandName(module.commandInFlight), true
+}
+
+// Failed returns true if the last update failed after OTA master acknowledged part of the update commands (e.g. install
+// succeeded but activate failed). The state is persisted, so it is reported after restart as well. The master may have
+// partially installed image: the update manager is expected to Revert the module, Update retries the update.
+func (module *RenesasUpdateModule) Failed() bool {
+	return module.getState() == failedState
+}
+
+// Ready returns true if the module is ready to perform update operations. The module is not ready if:
+//
+//   - OTA master queues can't be opened;
+//   - module state can't be read from storage or persisted state is invalid;
+//   - module state is unknown;
+//   - temporary target file is left by interrupted extraction.
+//
+// The result is cached for ReadyCacheTTL to avoid frequent OTA master IPC on health checks.
+func (module *RenesasUpdateModule) Ready() bool {
+	now := module.clock.Now()
+
+	module.stateMutex.Lock()
+
+	if !module.readyAt.IsZero() && now.Sub(module.readyAt) < module.config.ReadyCacheTTL.Duration {
+		defer module.stateMutex.Unlock()
+
+		return module.ready
+	}
+
+	module.stateMutex.Unlock()
+
+	err := module.checkReady()
+	if err != nil {
+		module.logger().Debugf("Module is not ready: %v", err)
+	}
+
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.ready, module.readyAt = err == nil, now
+
+	return module.ready
+}
+
+// SetExtractionConcurrency limits number of modules simultaneously extracting image in Prepare. The limit is shared
+// by all module instances of the process and doesn't affect OTA master command phases. If n is zero or negative,
+// extraction is not limited (default). Extractions already in progress are not affected by the new limit.
+func SetExtractionConcurrency(n int) {
+	extractionMutex.Lock()
+	defer extractionMutex.Unlock()
+
+	if n <= 0 {
+		extractionSemaphore = nil
+
+		return
+	}
+
+	extractionSemaphore = make(chan struct{}, n)
+}
+
+// CommandNames returns OTA master command names by command code. It may be used by external tools to decode messages
+// consistently with the module. The returned map is a copy and may be modified by the caller.
+func CommandNames() map[int64]string {
+	names := make(map[int64]string, len(otaCommandNames))
+
+	for name, command := range otaCommandNames {
+		names[command] = name
+	}
+
+	return names
+}
+
+// CommandCodes returns OTA master command codes by command name as used in configuration (timeouts, sequences).
+// The returned map is a copy and may be modified by the caller.
+func CommandCodes() map[string]int64 {
+	codes := make(map[string]int64, len(otaCommandNames))
+
+	for name, command := range otaCommandNames {
+		codes[name] = command
+	}
+
+	return codes
+}
+
+// CheckAll checks queues of all modules in parallel and returns check result per module ID. At most concurrency
+// checks are performed simultaneously; if concurrency is zero or negative, all modules are checked at once.
+func CheckAll(modules []*RenesasUpdateModule, concurrency int) map[string]error {
+	if concurrency <= 0 || concurrency > len(modules) {
+		concurrency = len(modules)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		results   = make(map[string]error)
+		semaphore = make(chan struct{}, concurrency)
+	)
+
+	for _, module := range modules {
+		wg.Add(1)
+
+		semaphore <- struct{}{}
+
+		go func(module *RenesasUpdateModule) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			err := module.CheckQueues()
+
+			mutex.Lock()
+			results[module.GetID()] = err
+			mutex.Unlock()
+		}(module)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// GetMasterVersion returns OTA master version.
+func (module *RenesasUpdateModule) GetMasterVersion() (version string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetMasterVersion, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(response), nil
+}
+
+// GetMasterConfig returns OTA master effective configuration (e.g. target device, slot layout, limits). The master
+// responds with key=value pairs separated by new line. Empty lines are ignored, a line without '=' is a protocol error.
+func (module *RenesasUpdateModule) GetMasterConfig() (config map[string]string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetMasterConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config = make(map[string]string)
+
+	for _, line := range strings.Split(string(response), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return nil, newReasonError(ReasonProtocolError, aoserrors.Errorf("wrong master config line: %s", line))
+		}
+
+		config[fields[0]] = fields[1]
+	}
+
+	return config, nil
+}
+
+// GetMasterFingerprint returns OTA master build fingerprint (e.g. git hash or build ID). The fingerprint is requested
+// once and cached for the module session.
+func (module *RenesasUpdateModule) GetMasterFingerprint() (fingerprint string, err error) {
+	module.stateMutex.Lock()
+	fingerprint = module.fingerprint
+	module.stateMutex.Unlock()
+
+	if fingerprint != "" {
+		return fingerprint, nil
+	}
+
+	response, err := module.queryOTAMaster(otaCommandGetFingerprint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint = string(response)
+
+	module.stateMutex.Lock()
+	module.fingerprint = fingerprint
+	module.stateMutex.Unlock()
+
+	module.logger().WithFields(log.Fields{"fingerprint": fingerprint}).Info("OTA master fingerprint")
+
+	return fingerprint, nil
+}
+
+// GetCapabilities returns OTA master capabilities: bit N is set if command N is supported.
+func (module *RenesasUpdateModule) GetCapabilities() (capabilities uint64, err error) {
+	return module.queryOTAMasterUint64(otaCommandGetCapabilities)
+}
+
+// GetFreeSpace returns OTA master free space in bytes.
+func (module *RenesasUpdateModule) GetFreeSpace() (freeSpace uint64, err error) {
+	return module.queryOTAMasterUint64(otaCommandGetFreeSpace)
+}
+
+// GetMasterUptime returns OTA master uptime. The master responds with uint64 uptime in milliseconds. If the master
+// has been restarted since the last command sent by the module, warning is logged as in-progress master state may be
+// lost. ErrUnsupported is returned if the master doesn't support uptime query.
+func (module *RenesasUpdateModule) GetMasterUptime() (uptime time.Duration, err error) {
+	module.stateMutex.Lock()
+	lastCommand := module.lastCommand
+	module.stateMutex.Unlock()
+
+	uptimeMs, err := module.queryOTAMasterUint64(otaCommandUptime)
+	if err != nil {
+		return 0, err
+	}
+
+	uptime = time.Duration(uptimeMs) * time.Millisecond
+
+	if !lastCommand.IsZero() && uptime < module.clock.Now().Sub(lastCommand) {
+		module.logger().WithFields(log.Fields{
+			"uptime":      uptime,
+			"lastCommand": lastCommand,
+		}).Warn("OTA master restarted since last command")
+	}
+
+	return uptime, nil
+}
+
+// GetPreparedAge returns how long the module has been in prepared state. The second return value is false if no
+// prepared image is currently staged.
+func (module *RenesasUpdateModule) GetPreparedAge() (age time.Duration, prepared bool) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	if module.State != preparedState {
+		return 0, false
+	}
+
+	return module.clock.Now().Sub(module.PreparedAt), true
+}
+
+// SetMasterVerbose turns OTA master verbose logging on or off. If MasterVerboseDuringUpdate is set, verbose logging is
+// also turned on for the time of Prepare and Update and then restored to the setting the master had before. If the
+// master doesn't support verbose logging control, the error wraps ErrUnsupported.
+func (module *RenesasUpdateModule) SetMasterVerbose(on bool) error {
+	_, err := module.setMasterVerbose(on)
+
+	return err
+}
+
+// SetBootAttemptLimit sets number of failed boots of the new image after which A/B OTA master reverts to the
+// previous image by itself. The limit is sent as uint32 payload and applies to the image installed next, that's why
+// Update sends it before install when BootAttemptLimit is configured. This rollback is performed by the master
+// hardware regardless of module Revert calls.
+func (module *RenesasUpdateModule) SetBootAttemptLimit(limit int) error {
+	if limit <= 0 {
+		return aoserrors.Errorf("wrong boot attempt limit: %d", limit)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err := binary.Write(buffer, module.byteOrder, uint32(limit)); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if _, err := module.queryOTAMaster(otaCommandSetBootLimit, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ProgressChannel returns progress events channel of the current Prepare or Update operation. If no operation is in
+// progress, the channel is created for the next one. The channel is buffered with progressChannelSize events; events
+// that don't fit into the buffer are dropped, so a slow consumer never stalls the operation. The channel is closed
+// when the operation finishes, successfully or not.
+func (module *RenesasUpdateModule) ProgressChannel() <-chan ProgressEvent {
+	module.progressMutex.Lock()
+	defer module.progressMutex.Unlock()
+
+	if module.progressChannel == nil {
+		module.progressChannel = make(chan ProgressEvent, progressChannelSize)
+	}
+
+	return module.progressChannel
+}
+
+// GetThermalState returns OTA master thermal state. The master responds with int32 temperature in millidegrees
+// Celsius followed by uint32 flags: bit 0 is set if flash writes are throttled.
+func (module *RenesasUpdateModule) GetThermalState() (state ThermalState, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetThermalState, nil)
+	if err != nil {
+		return ThermalState{}, err
+	}
+
+	var thermal struct {
+		Temperature int32
+		Flags       uint32
+	}
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &thermal); err != nil {
+		return ThermalState{}, newReasonError(ReasonProtocolError, err)
+	}
+
+	return ThermalState{
+		Temperature: float64(thermal.Temperature) / 1000,
+		Throttled:   thermal.Flags&1 != 0,
+	}, nil
+}
+
+// GetEffectiveTimeout returns timeout applied to the named command. Per-command timeout from CommandTimeouts takes
+// precedence over RebootTimeout (applied to reboot command) and base Timeout.
+func (module *RenesasUpdateModule) GetEffectiveTimeout(command string) time.Duration {
+	if timeout, ok := module.config.CommandTimeouts[command]; ok {
+		return timeout.Duration
+	}
+
+	if command == "reboot" && module.config.RebootTimeout.Duration > 0 {
+		return module.config.RebootTimeout.Duration
+	}
+
+	return module.config.Timeout.Duration
+}
+
+// GetActiveVersion returns vendor version of the image currently active on OTA master.
+func (module *RenesasUpdateModule) GetActiveVersion() (version string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetActiveVersion, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(response), nil
+}
+
+// GetMasterComponentVersions returns installed versions of components managed by OTA master. The master responds with
+// uint32 components count followed by name and version of each component. Name and version are uint16 length prefixed
+// strings. If the master doesn't report components, it is considered single-component master and the map contains
+// the active version (see GetActiveVersion) of the module ID.
+func (module *RenesasUpdateModule) GetMasterComponentVersions() (versions map[string]string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetComponents, nil)
+	if err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			return nil, err
+		}
+
+		version, err := module.GetActiveVersion()
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]string{module.id: version}, nil
+	}
+
+	reader := bytes.NewReader(response)
+
+	var count uint32
+
+	if err = binary.Read(reader, module.byteOrder, &count); err != nil {
+		return nil, newReasonError(ReasonProtocolError, err)
+	}
+
+	versions = make(map[string]string)
+
+	for i := uint32(0); i < count; i++ {
+		name, err := module.readString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		version, err := module.readString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		versions[name] = version
+	}
+
+	if reader.Len() != 0 {
+		return nil, newReasonError(ReasonProtocolError,
+			aoserrors.Errorf("unexpected %d bytes after component versions", reader.Len()))
+	}
+
+	return versions, nil
+}
+
+// GetMasterLastGoodVersion returns vendor version of the last image the master confirmed as successfully booted. The
+// master responds with the version string. Right after activation, until the master confirms the boot, it differs
+// from the version returned by GetActiveVersion and is the version the master rolls back to if the boot fails. If the
+// master doesn't track confirmed boots, the error wraps ErrUnsupported.
+func (module *RenesasUpdateModule) GetMasterLastGoodVersion() (version string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetLastGood, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(response), nil
+}
+
+// GetMasterQueueCapacity returns number of free slots in OTA master command intake queue. The master responds with
+// uint32 number of commands it can accept without blocking. The module itself sends commands one at a time and waits
+// for the status of each before sending the next one, so it never has more than one command in the intake queue;
+// the capacity is intended for clients sharing the master to pace their bursts. ErrUnsupported is returned if the
+// master doesn't report the capacity.
+func (module *RenesasUpdateModule) GetMasterQueueCapacity() (capacity int, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetQueueCapacity, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint32
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &value); err != nil {
+		return 0, newReasonError(ReasonProtocolError, err)
+	}
+
+	return int(value), nil
+}
+
+// GetMasterQueueDepth returns number of updates queued on OTA master from all clients. The master responds with
+// uint32 queue depth.
+func (module *RenesasUpdateModule) GetMasterQueueDepth() (depth int, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetQueueDepth, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint32
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &value); err != nil {
+		return 0, newReasonError(ReasonProtocolError, err)
+	}
+
+	return int(value), nil
+}
+
+// GetLastImagePath returns image path of the last successful Prepare.
+func (module *RenesasUpdateModule) GetLastImagePath() string {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.LastImagePath
+}
+
+// IsRebootSafe returns whether reboot at the current moment doesn't interrupt critical OTA master flash write. The
+// master responds with uint32 flag (1 - safe, 0 - unsafe) followed by reason text. If the master doesn't support the
+// query, reboot is reported as safe.
+func (module *RenesasUpdateModule) IsRebootSafe() (safe bool, reason string, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetRebootSafety, nil)
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			return true, "OTA master doesn't report reboot safety", nil
+		}
+
+		return false, "", err
+	}
+
+	reader := bytes.NewReader(response)
+
+	var flag uint32
+
+	if err = binary.Read(reader, module.byteOrder, &flag); err != nil {
+		return false, "", newReasonError(ReasonProtocolError, err)
+	}
+
+	return flag != 0, string(response[len(response)-reader.Len():]), nil
+}
+
+// GetLastPhaseTimings returns durations of the last update phases: extract, syncCompose, download, install and
+// activate. Timings are reset on each Prepare.
+func (module *RenesasUpdateModule) GetLastPhaseTimings() map[string]time.Duration {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	timings := make(map[string]time.Duration, len(module.PhaseTimings))
+
+	for phase, duration := range module.PhaseTimings {
+		timings[phase] = duration
+	}
+
+	return timings
+}
+
+// StatusJSON returns compact module status document to be reported to fleet backend as is:
+//
+//	schemaVersion  document schema version, incremented on incompatible changes
+//	id             module ID
+//	state          module state: idle, prepared, updated or failed
+//	vendorVersion  installed vendor version
+//	pendingVersion prepared or previous (after update) vendor version
+//	lastResult     result of the last Prepare, Update, Revert or PurgeMaster operation of the session
+//	phaseTimingsMs durations of the last prepare phases in milliseconds
+//	rebootPending  the update is installed and the master requested reboot to activate it
+//	stats          OTA master protocol statistics (see ProtocolStats)
+func (module *RenesasUpdateModule) StatusJSON() ([]byte, error) {
+	data, err := json.Marshal(module.statusSnapshot())
+	if err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// GetProtocolStats returns OTA master protocol statistics.
+func (module *RenesasUpdateModule) GetProtocolStats() ProtocolStats {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.stats
+}
+
+// GetUpdateCount returns number of successful updates performed by the module.
+func (module *RenesasUpdateModule) GetUpdateCount() int {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.UpdateCount
+}
+
+// GetNegotiatedProtocol returns OTA master protocol version used in the current session.
+func (module *RenesasUpdateModule) GetNegotiatedProtocol() int {
+	return module.protocol
+}
+
+func (state updateState) String() string {
+	names := []string{"idle", "prepared", "updated", "failed"}
+
+	if state < 0 || int(state) >= len(names) {
+		return fmt.Sprintf("unknown(%d)", int(state))
+	}
+
+	return names[state]
+}
+
+// UnmarshalJSON unmarshals target file list from JSON array or single file name.
+func (files *targetFiles) UnmarshalJSON(data []byte) error {
+	var file string
+
+	if err := json.Unmarshal(data, &file); err == nil {
+		*files = targetFiles{file}
+
+		return nil
+	}
+
+	var list []string
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	*files = list
+
+	return nil
+}
+
+/***********************************************************************************************************************
+ * Private
+ **********************************************************************************************************************/
+
+// runOperation runs module operation: Prepare, Update, Revert, Apply, Reboot or PurgeMaster. If SerializeOperations
+// is set, the operation is queued and executed by a single worker: operations are executed one at a time in the order
+// of calls and each caller receives result of its own operation. OTA master requests of the operation are canceled
+// with ctx.
+//
+// Cleanup actions registered by the operation with addCleanup are run when the operation finishes. If the operation
+// panics, the panic is recovered, cleanup actions are run and the panic is returned as the operation error. Debounced
+// module state is saved before the result is returned to the caller.
+func (module *RenesasUpdateModule) runOperation(
+	ctx context.Context, handler func() (rebootRequired bool, err error),
+) (rebootRequired bool, err error) {
+	run := func() (rebootRequired bool, err error) {
+		if err := ctx.Err(); err != nil {
+			return false, aoserrors.Wrap(err)
+		}
+
+		module.setOperationContext(ctx)
+		defer module.setOperationContext(nil)
+
+		module.startOperation()
+		defer module.finishOperation()
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				module.logger().Errorf("Operation panic: %v\n%s", recovered, debug.Stack())
+
+				rebootRequired, err = false, aoserrors.Errorf("operation panic: %v", recovered)
+			}
+
+			module.runCleanups()
+
+			if flushErr := module.flushState(); flushErr != nil && err == nil {
+				err = flushErr
+			}
+
+			module.setLastResult(err)
+		}()
+
+		return handler()
+	}
+
+	if !module.config.SerializeOperations {
+		return run()
+	}
+
+	op := &operation{run: run, result: make(chan operationResult, 1)}
+
+	module.operationMutex.Lock()
+
+	if module.closed {
+		module.operationMutex.Unlock()
+
+		return false, aoserrors.Wrap(ErrModuleClosed)
+	}
+
+	module.operations = append(module.operations, op)
+
+	module.operationMutex.Unlock()
+
+	module.notifyOperations()
+
+	result := <-op.result
+
+	return result.rebootRequired, result.err
+}
+
+// addCleanup registers cleanup action of the running operation. Actions are run in reverse order of registration when
+// the operation finishes, even if it panics.
+func (module *RenesasUpdateModule) addCleanup(cleanup func()) {
+	module.cleanups = append(module.cleanups, cleanup)
+}
+
+func (module *RenesasUpdateModule) runCleanups() {
+	for len(module.cleanups) > 0 {
+		cleanup := module.cleanups[len(module.cleanups)-1]
+		module.cleanups = module.cleanups[:len(module.cleanups)-1]
+
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					module.logger().Errorf("Cleanup panic: %v", recovered)
+				}
+			}()
+
+			cleanup()
+		}()
+	}
+}
+
+func (module *RenesasUpdateModule) startOperation() {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	module.operationCount++
+	module.operationID = fmt.Sprintf("%s-%x-%d", module.id, module.sessionStart.Unix(), module.operationCount)
+}
+
+// statusSnapshot builds status document from a consistent snapshot of the module state.
+func (module *RenesasUpdateModule) statusSnapshot() statusDocument {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	status := statusDocument{
+		SchemaVersion:  statusSchemaVersion,
+		ID:             module.id,
+		State:          module.State.String(),
+		VendorVersion:  module.VendorVersion,
+		PendingVersion: module.PendingVersion,
+		LastResult:     module.lastResult,
+		RebootPending:  module.State == updatedState && module.rebootRequired,
+		Stats: statusStats{
+			CommandsSent:     module.stats.CommandsSent,
+			Failures:         module.stats.Failures,
+			Timeouts:         module.stats.Timeouts,
+			Retries:          module.stats.Retries,
+			BytesTransferred: module.stats.BytesTransferred,
+		},
+	}
+
+	if len(module.PhaseTimings) > 0 {
+		status.PhaseTimingsMs = make(map[string]int64, len(module.PhaseTimings))
+
+		for phase, duration := range module.PhaseTimings {
+			status.PhaseTimingsMs[phase] = duration.Milliseconds()
+		}
+	}
+
+	return status
+}
+
+func (module *RenesasUpdateModule) setLastResult(err error) {
+	result := &operationStatus{
+		OperationID: module.CurrentOperationID(),
+		Success:     err == nil,
+		FinishedAt:  module.clock.Now(),
+	}
+
+	if err != nil {
+		result.Reason = ErrorCode(err)
+		result.Error = err.Error()
+	}
+
+	module.stateMutex.Lock()
+	module.lastResult = result
+	module.stateMutex.Unlock()
+}
+
+func (module *RenesasUpdateModule) finishOperation() {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	module.operationID = ""
+}
+
+// operationContext returns context of the running operation or nil if no operation is running.
+func (module *RenesasUpdateModule) operationContext() context.Context {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	return module.ctx
+}
+
+func (module *RenesasUpdateModule) setOperationContext(ctx context.Context) {
+	module.operationMutex.Lock()
+	defer module.operationMutex.Unlock()
+
+	module.ctx = ctx
+}
+
+// logger returns log entry with module ID and, if an operation is running, the operation ID.
+func (module *RenesasUpdateModule) logger() *log.Entry {
+	entry := log.WithField("id", module.id)
+
+	if operationID := module.CurrentOperationID(); operationID != "" {
+		entry = entry.WithField("operationId", operationID)
+	}
+
+	return entry
+}
+
+func (module *RenesasUpdateModule) processOperations() {
+	defer close(module.workerDone)
+
+	for {
+		module.operationMutex.Lock()
+
+		if len(module.operations) == 0 {
+			closed := module.closed
+
+			module.operationMutex.Unlock()
+
+			if closed {
+				return
+			}
+
+			<-module.operationNotify
+
+			continue
+		}
+
+		op := module.operations[0]
+		module.operations = module.operations[1:]
+		module.runningOperation = op
+
+		module.operationMutex.Unlock()
+
+		rebootRequired, err := op.run()
+
+		module.operationMutex.Lock()
+		module.runningOperation = nil
+		module.operationMutex.Unlock()
+
+		op.result <- operationResult{rebootRequired: rebootRequired, err: err}
+	}
+}
+
+func (module *RenesasUpdateModule) notifyOperations() {
+	select {
+	case module.operationNotify <- struct{}{}:
+
+	default:
+	}
+}
+
+func (module *RenesasUpdateModule) prepare(
+	imagePath string, vendorVersion string, annotations json.RawMessage,
+) (err error) {
+	module.logger().WithFields(log.Fields{
+		"imagePath":     imagePath,
+		"vendorVersion": vendorVersion,
+	}).Debug("Prepare renesasupdate module")
+
+	if module.getState() == preparedState {
+		return nil
+	}
+
+	if err := module.checkVersionScheme(vendorVersion); err != nil {
+		return err
+	}
+
+	if module.config.MasterVerboseDuringUpdate {
+		defer module.enableMasterVerbose()()
+	}
+
+	if !module.isVersionAllowed(vendorVersion) {
+		return newReasonError(ReasonVersionNotAllowed,
+			aoserrors.Errorf("vendor version %s is not in allowed versions list", vendorVersion))
+	}
+
+	targetOverride, err := module.resolveTargetOverride(annotations)
+	if err != nil {
+		return err
+	}
+
+	module.stateMutex.Lock()
+	module.TargetOverride = targetOverride
+	module.stateMutex.Unlock()
+
+	if module.config.UseMasterTransaction {
+		defer func() {
+			if err != nil {
+				module.rollbackTransaction()
+			}
+		}()
+
+		if err = module.beginTransaction(); err != nil {
+			return err
+		}
+	}
+
+	sourcePath := imagePath
+
+	if isRemoteImage(imagePath) {
+		var err error
+
+		if imagePath, err = module.fetchImage(imagePath, annotations); err != nil {
+			return err
+		}
+
+		fetchDir := filepath.Dir(imagePath)
+
+		module.addCleanup(func() {
+			if err := os.RemoveAll(fetchDir); err != nil {
+				module.logger().WithField("dir", fetchDir).Errorf("Can't remove fetch directory: %v", err)
+			}
+		})
+	}
+
+	if module.config.MaxMasterQueueDepth > 0 {
+		if err := module.checkQueueDepth(); err != nil {
+			return err
+		}
+	}
+
+	if module.config.ProbeBeforeUpdate {
+		if err := module.probeMaster(imagePath); err != nil {
+			return err
+		}
+	}
+
+	// Extraction detects compression anyway, the option only rejects images which can't be extracted before the
+	// master is involved.
+	if module.config.AutoDetectCompression {
+		if _, err := module.imageCompression(imagePath); err != nil {
+			return err
+		}
+	}
+
+	module.resetPhaseTimings()
+
+	if module.isImageExtracted(sourcePath, vendorVersion) {
+		module.logger().WithFields(log.Fields{
+			"targetFiles": module.targetFiles(),
+		}).Info("Image is already extracted, skip extraction")
+	} else if module.isMultiTarget() {
+		if err := module.extractTargets(imagePath, sourcePath, vendorVersion, annotations); err != nil {
+			return err
+		}
+	} else if err := module.extractTarget(imagePath, sourcePath, vendorVersion, annotations); err != nil {
+		return err
+	}
+
+	if module.config.PreallocateOnMaster {
+		if err := module.preallocateOnMaster(); err != nil {
+			return err
+		}
+	}
+
+	if module.config.PreservePreviousSlot {
+		if err := module.preservePreviousSlot(); err != nil {
+			return err
+		}
+	}
+
+	module.reportProgress(ProgressPhaseDownload, 40)
+
+	if module.isMultiTarget() {
+		if err := module.downloadTargets(); err != nil {
+			return err
+		}
+	} else if module.config.UploadChunkSize > 0 {
+		if err := module.uploadImage(vendorVersion); err != nil {
+			return err
+		}
+	} else if targetOverride != "" {
+		if err := module.downloadTargets(); err != nil {
+			return err
+		}
+	} else if commands, ok := module.sequences[sequencePrepare]; ok {
+		if err := module.sendOTACommands(commands...); err != nil {
+			return err
+		}
+	} else if err := module.downloadImage(); err != nil {
+		return err
+	}
+
+	if module.config.VerifyPreparedOnMaster {
+		if err := module.verifyMasterReady(); err != nil {
+			return err
+		}
+	}
+
+	if module.config.MasterVerifiesSignature {
+		module.reportProgress(ProgressPhaseVerify, 80)
+
+		if err := module.verifyMasterSignature(); err != nil {
+			return err
+		}
+	}
+
+	module.setPendingVersion(vendorVersion)
+	module.setLastImagePath(sourcePath)
+
+	module.stateMutex.Lock()
+	module.ExtractedImage = nil
+	module.stateMutex.Unlock()
+
+	if err := module.setState(preparedState); err != nil {
+		return err
+	}
+
+	module.reportProgress(ProgressPhaseDone, 100)
+
+	return nil
+}
+
+func (module *RenesasUpdateModule) update() (rebootRequired bool, err error) {
+	module.logger().Debug("Update renesasupdate module")
+
+	defer module.finishProgress()
+
+	if module.getState() == updatedState {
+		return false, nil
+	}
+
+	if module.config.MasterVerboseDuringUpdate {
+		defer module.enableMasterVerbose()()
+	}
+
+	// Transaction opened by prepare is rolled back on any update failure, including expired deadline.
+	defer func() {
+		if err != nil {
+			module.rollbackTransaction()
+		}
+	}()
+
+	module.setRebootRequired(false)
+
+	if module.getState() == preparedState && module.getPendingVersion() == "" {
+		if module.config.StrictVersioning {
+			return false, aoserrors.New("pending version is empty, module should be prepared again")
+		}
+
+		module.logger().Warn("Pending version is empty, vendor version will be lost")
+	}
+
+	if module.config.MasterDeadline.Duration > 0 {
+		if err := module.setMasterDeadline(module.clock.Now().Add(module.config.MasterDeadline.Duration)); err != nil {
+			return false, err
+		}
+	}
+
+	if module.config.MaxUpdateTemperature != 0 {
+		if err := module.checkTemperature(); err != nil {
+			return false, err
+		}
+	}
+
+	module.reportProgress(ProgressPhaseInstall, 0)
+
+	if module.config.BootAttemptLimit > 0 {
+		if err := module.SetBootAttemptLimit(module.config.BootAttemptLimit); err != nil {
+			if !errors.Is(err, ErrUnsupported) {
+				return false, err
+			}
+
+			module.logger().Warn("OTA master doesn't support boot attempt limit, skip")
+		}
+	}
+
+	if err := module.sendUpdateCommands(); err != nil {
+		return false, err
+	}
+
+	if module.config.ConfirmActiveVersion {
+		if err := module.confirmActiveVersion(); err != nil {
+			return false, err
+		}
+	}
+
+	if err := module.commitTransaction(); err != nil {
+		return false, err
+	}
+
+	module.swapVersions()
+	module.incrementUpdateCount()
+
+	if err := module.setState(updatedState); err != nil {
+		return false, err
+	}
+
+	module.reportProgress(ProgressPhaseDone, 100)
+
+	return module.rebootRequired, nil
+}
+
+// setMasterDeadline sends otaCommandSetDeadline with int64 unix timestamp (seconds) of the time the master must finish
+// the update by. The master is expected to abort an operation (e.g. long background verification) which would exceed
+// the deadline: the aborted command fails with failure status, so Update fails and the module stays prepared (or
+// failed if the master acknowledged part of the update). The deadline is skipped if the master doesn't support it.
+func (module *RenesasUpdateModule) setMasterDeadline(deadline time.Time) error {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := binary.Write(buffer, module.byteOrder, deadline.Unix()); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if _, err := module.queryOTAMaster(otaCommandSetDeadline, buffer.Bytes()); err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		module.logger().Warn("OTA master doesn't support deadline, skip")
+	}
+
+	return nil
+}
+
+// sendUpdateCommands sends update sequence or installs the image. If the commands fail after the master acknowledged
+// some of them, the module enters failed state. With RollbackOnPartialFailure the acknowledged commands are rolled
+// back first (see rollbackPartialUpdate) and, if the master reverts the update, the module becomes idle instead.
+func (module *RenesasUpdateModule) sendUpdateCommands() (err error) {
+	module.batchAcknowledged = 0
+
+	if commands, ok := module.sequences[sequenceUpdate]; ok {
+		err = module.sendOTACommands(commands...)
+	} else {
+		err = module.installImage()
+	}
+
+	if err != nil && module.batchAcknowledged > 0 {
+		module.logger().WithFields(log.Fields{
+			"acknowledged": module.batchAcknowledged,
+		}).Errorf("Update failed partway: %v", err)
+
+		state := updateState(failedState)
+
+		if module.config.RollbackOnPartialFailure && module.rollbackPartialUpdate() {
+			state = idleState
+		}
+
+		if stateErr := module.setState(state); stateErr != nil {
+			module.logger().Errorf("Can't save module state: %v", stateErr)
+		}
+	}
+
+	return err
+}
+
+// rollbackPartialUpdate sends revert sequence to compensate update commands acknowledged by the master before the
+// update failed. It returns true if the master reverted the update. Rollback failure is logged only: the update error
+// is reported to the caller and the module stays failed.
+func (module *RenesasUpdateModule) rollbackPartialUpdate() bool {
+	module.logger().WithFields(log.Fields{
+		"acknowledged": module.batchAcknowledged,
+	}).Warn("Roll back partially applied update")
+
+	if err := module.sendOTACommands(module.revertCommands()...); err != nil {
+		module.logger().Errorf("Can't roll back partially applied update: %v", err)
+
+		return false
+	}
+
+	module.logger().Info("Partially applied update rolled back")
+
+	return true
+}
+
+// revertCommands returns revert sequence or, if not configured, otaCommandRevert.
+func (module *RenesasUpdateModule) revertCommands() []int64 {
+	if commands, ok := module.sequences[sequenceRevert]; ok {
+		return commands
+	}
+
+	return []int64{otaCommandRevert}
+}
+
+func (module *RenesasUpdateModule) revert() (rebootRequired bool, err error) {
+	module.logger().Debug("Revert renesasupdate module")
+
+	state := module.getState()
+
+	if state == idleState {
+		return false, nil
+	}
+
+	module.rollbackTransaction()
+
+	if err := module.sendOTACommands(module.revertCommands()...); err != nil {
+		return false, err
+	}
+
+	if (state == preparedState || state == failedState) && module.config.CleanupOnRevert {
+		if err := module.discardPrepared(); err != nil {
+			return false, err
+		}
+	}
+
+	if state == updatedState {
+		module.swapVersions()
+	}
+
+	if err := module.setState(idleState); err != nil {
+		return false, err
+	}
+
+	return rebootRequired, nil
+}
+
+func (module *RenesasUpdateModule) apply() (rebootRequired bool, err error) {
+	module.logger().Debug("Apply renesasupdate module")
+
+	state := module.getState()
+
+	if state == idleState {
+		if module.config.StrictApply {
+			return false, aoserrors.Wrap(ErrNothingToApply)
+		}
+
+		return false, nil
+	}
+
+	if state != updatedState {
+		return false, aoserrors.Errorf("can't apply update in %s state, module should be reverted", state)
+	}
+
+	if err := module.setState(idleState); err != nil {
+		return false, err
+	}
+
+	if err := module.flushState(); err != nil {
+		return false, err
+	}
+
+	if module.config.CleanupTargetOnApply {
+		// The update is already committed at this point, so failure is logged only.
+		if err := module.removeTargets(); err != nil {
+			module.logger().Errorf("Can't remove target files: %v", err)
+		}
+	}
+
+	return false, nil
+}
+
+func (module *RenesasUpdateModule) reboot() (err error) {
+	module.logger().Debugf("Reboot renesasupdate module")
+
+	if module.config.ConfirmReboot {
+		if err := module.setRebootRequestedAt(module.clock.Now()); err != nil {
+			return err
+		}
+
+		defer func() {
+			if err != nil {
+				if clearErr := module.setRebootRequestedAt(time.Time{}); clearErr != nil {
+					module.logger().Errorf("Can't save module state: %v", clearErr)
+				}
+			}
+		}()
+	}
+
+	if module.config.RebootCommand == "" {
+		if _, err := module.queryOTAMaster(otaCommandReboot, nil); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.GetEffectiveTimeout("reboot"))
+	defer cancel()
+
+	if output, err := exec.CommandContext(ctx, "sh", "-c", module.config.RebootCommand).CombinedOutput(); err != nil {
+		return aoserrors.Errorf("reboot command failed: %v (%s)", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// getModuleState gets module state from storage. Transient storage errors are retried StorageRetries times, the delay
+// starts from StorageRetryDelay and doubles after each attempt.
+func (module *RenesasUpdateModule) getModuleState() (state []byte, err error) {
+	delay := module.config.StorageRetryDelay.Duration
+
+	for i := 0; ; i++ {
+		if state, err = module.storage.GetModuleState(module.id); err == nil {
+			return state, nil
+		}
+
+		if i >= module.config.StorageRetries || isPermanentStorageError(err) {
+			return nil, aoserrors.Wrap(err)
+		}
+
+		module.logger().WithFields(log.Fields{"attempt": i + 1}).Warnf("Can't get module state: %v", err)
+
+		<-module.clock.After(delay)
+
+		delay *= 2
+	}
+}
+
+func (module *RenesasUpdateModule) reportProgress(phase string, percent int) {
+	module.progressMutex.Lock()
+	defer module.progressMutex.Unlock()
+
+	if module.progressChannel == nil {
+		return
+	}
+
+	select {
+	case module.progressChannel <- ProgressEvent{
+		OperationID: module.CurrentOperationID(), Phase: phase, Percent: percent, Timestamp: module.clock.Now(),
+	}:
+
+	default:
+		module.logger().WithFields(log.Fields{"phase": phase}).Warn("Progress event dropped")
+	}
+}
+
+func (module *RenesasUpdateModule) finishProgress() {
+	module.progressMutex.Lock()
+	defer module.progressMutex.Unlock()
+
+	if module.progressChannel != nil {
+		close(module.progressChannel)
+		module.progressChannel = nil
+	}
+}
+
+// emitEvent fills module ID and timestamp of the event and passes it to the event handler, if set.
+func (module *RenesasUpdateModule) emitEvent(event Event) {
+	if module.events == nil {
+		return
+	}
+
+	event.ModuleID, event.Timestamp = module.id, module.clock.Now()
+
+	module.events(event)
+}
+
+func (module *RenesasUpdateModule) setState(state updateState) error {
+	module.logger().WithFields(log.Fields{"state": state}).Debugf("State changed")
+
+	module.stateMutex.Lock()
+
+	module.State = state
+	module.PreparedAt = time.Time{}
+
+	if state == preparedState {
+		module.PreparedAt = module.clock.Now()
+	}
+
+	module.stateMutex.Unlock()
+
+	module.emitEvent(Event{Type: EventStateChanged, State: state.String()})
+	module.metrics.StateChanged(module.id, state.String())
+
+	return module.saveState()
+}
+
+func (module *RenesasUpdateModule) getState() updateState {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.State
+}
+
+func (module *RenesasUpdateModule) getPendingVersion() string {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.PendingVersion
+}
+
+func (module *RenesasUpdateModule) setPendingVersion(version string) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.PendingVersion = version
+}
+
+func (module *RenesasUpdateModule) incrementUpdateCount() {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.UpdateCount++
+}
+
+func (module *RenesasUpdateModule) setLastImagePath(imagePath string) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.LastImagePath = imagePath
+}
+
+// swapVersions swaps vendor and pending versions on activation or revert.
+func (module *RenesasUpdateModule) swapVersions() {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.VendorVersion, module.PendingVersion = module.PendingVersion, module.VendorVersion
+}
+
+// saveState persists module state. If StateWriteDebounce is configured, the state written less than StateWriteDebounce
+// ago is only marked dirty: it is written by the next saveState after the window or by flushState, which is called
+// before public methods return, so the state is durable at method boundaries.
+func (module *RenesasUpdateModule) saveState() error {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	if module.config.StateWriteDebounce.Duration > 0 && !module.stateWrittenAt.IsZero() &&
+		module.clock.Now().Sub(module.stateWrittenAt) < module.config.StateWriteDebounce.Duration {
+		module.stateDirty = true
+
+		return nil
+	}
+
+	return module.writeState()
+}
+
+// flushState writes module state postponed by saveState.
+func (module *RenesasUpdateModule) flushState() error {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	if !module.stateDirty {
+		return nil
+	}
+
+	return module.writeState()
+}
+
+// writeState writes module state to the storage. It should be called with stateMutex held.
+func (module *RenesasUpdateModule) writeState() error {
+	if module.config.PersistStats {
+		stats := module.stats
+		module.Stats = &stats
+	}
+
+	data, err := module.marshalState(module)
+	if err != nil {
+		return err
+	}
+
+	if module.config.StateHMACKey != "" {
+		if data, err = module.marshalState(signedState{State: data, HMAC: module.stateHMAC(data)}); err != nil {
+			return err
+		}
+	}
+
+	if err = module.storage.SetModuleState(module.id, data); err != nil {
+		return newReasonError(ReasonStorageFailed, err)
+	}
+
+	module.stateDirty = false
+	module.stateWrittenAt = module.clock.Now()
+
+	return nil
+}
+
+// loadState restores persisted module state. If StateHMACKey is configured, the state is stored with HMAC-SHA256
+// signature. State with wrong signature is ignored (module starts in idle state) or, if StrictStateIntegrity is set,
+// fails module creation.
+func (module *RenesasUpdateModule) loadState(data []byte) error {
+	if module.config.StateHMACKey != "" {
+		var signed signedState
+
+		if err := unmarshalState(data, &signed); err != nil {
+			return err
+		}
+
+		if !hmac.Equal([]byte(signed.HMAC), []byte(module.stateHMAC(signed.State))) {
+			if module.config.StrictStateIntegrity {
+				return aoserrors.New("module state integrity check failed")
+			}
+
+			module.logger().Warn("Module state integrity check failed, reset to idle")
+
+			return nil
+		}
+
+		data = signed.State
+	}
+
+	return unmarshalState(data, module)
+}
+
+// marshalState encodes value with configured state format.
+func (module *RenesasUpdateModule) marshalState(value interface{}) (data []byte, err error) {
+	switch module.config.StateFormat {
+	case stateFormatGob:
+		buffer := bytes.NewBuffer([]byte{stateGobMagic})
+
+		if err = gob.NewEncoder(buffer).Encode(value); err != nil {
+			return nil, aoserrors.Wrap(err)
+		}
+
+		return buffer.Bytes(), nil
+
+	case stateFormatCBOR:
+		if data, err = cbor.Marshal(value); err != nil {
+			return nil, aoserrors.Wrap(err)
+		}
+
+		return append(append([]byte{}, stateCBORMagic...), data...), nil
+	}
+
+	if data, err = json.Marshal(value); err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// unmarshalState decodes value with format detected by data prefix.
+func unmarshalState(data []byte, value interface{}) error {
+	if len(data) > 0 && data[0] == stateGobMagic {
+		if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(value); err != nil {
+			return aoserrors.Wrap(err)
+		}
+
+		return nil
+	}
+
+	if bytes.HasPrefix(data, stateCBORMagic) {
+		if err := cbor.Unmarshal(data[len(stateCBORMagic):], value); err != nil {
+			return aoserrors.Wrap(err)
+		}
+
+		return nil
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	return nil
+}
+
+func (module *RenesasUpdateModule) stateHMAC(data []byte) string {
+	mac := hmac.New(sha256.New, []byte(module.config.StateHMACKey))
+
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (module *RenesasUpdateModule) probeMaster(imagePath string) error {
+	version, err := module.GetMasterVersion()
+	if err != nil {
+		return err
+	}
+
+	capabilities, err := module.GetCapabilities()
+	if err != nil {
+		return err
+	}
+
+	freeSpace, err := module.GetFreeSpace()
+	if err != nil {
+		return err
+	}
+
+	requiredSpace, err := module.getImageSize(imagePath)
+	if err != nil {
+		return err
+	}
+
+	module.logger().WithFields(log.Fields{
+		"version":       version,
+		"capabilities":  fmt.Sprintf("0x%x", capabilities),
+		"freeSpace":     freeSpace,
+		"requiredSpace": requiredSpace,
+	}).Debug("Probe OTA master")
+
+	requiredCapabilities := commandsMask(otaCommandSyncCompose, otaCommandDownload, otaCommandInstall,
+		otaCommandActivate, otaCommandRevert)
+
+	if missing := requiredCapabilities &^ capabilities; missing != 0 {
+		return newReasonError(ReasonUnsupported, aoserrors.Errorf(
+			"OTA master doesn't support required commands 0x%x: %w", missing, ErrUnsupported))
+	}
+
+	if freeSpace < requiredSpace {
+		return newReasonError(ReasonInsufficientSpace, aoserrors.Errorf(
+			"not enough space on OTA master: required %d, available %d", requiredSpace, freeSpace))
+	}
+
+	return nil
+}
+
+// uploadImage streams target file to OTA master in chunks. Each chunk is sent as otaCommandUploadChunk request with
+// the following payload (in protocol byte order):
+//
+//	uint32 index  chunk index starting from 0
+//	uint32 length data length
+//	uint32 crc    CRC32 (IEEE) of data
+//	[]byte data
+//
+// The master responds with otaStatusChunkCorrupted if the chunk CRC doesn't match; in this case the chunk is resent up
+// to otaChunkMaxRetries times. Index of the next chunk to send is persisted after each acknowledged chunk, so an
+// interrupted upload of the same version is resumed from this chunk instead of starting with otaCommandSyncCompose.
+// After all chunks are acknowledged, otaCommandDownload is sent to finalize the image on the master.
+//
+// If VerifyEachChunk is set, each acknowledged chunk is additionally verified on the master (see verifyChunk) and
+// resent on verification failure. It catches chunks corrupted after reception (e.g. while written to master storage)
+// without resending the whole image, at the cost of an extra round-trip per chunk: the smaller UploadChunkSize, the
+// higher the verification overhead.
+//
+// The chunk size is persisted with the chunk index: if it differs on resume (see getChunkSize), the upload is
+// restarted.
+func (module *RenesasUpdateModule) uploadImage(vendorVersion string) error {
+	file, err := os.Open(module.primaryTarget())
+	if err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+	defer file.Close()
+
+	module.stateMutex.Lock()
+
+	if module.PendingVersion != vendorVersion {
+		module.UploadedChunks = 0
+	}
+
+	uploadedChunks, prevChunkSize := module.UploadedChunks, module.ChunkSize
+
+	module.stateMutex.Unlock()
+
+	return module.withOTAQueues(func(sendMQ, recvMQ *posix_mq.MessageQueue) error {
+		chunkSize, err := module.getChunkSize(sendMQ, recvMQ)
+		if err != nil {
+			return err
+		}
+
+		if uploadedChunks != 0 && prevChunkSize != 0 && prevChunkSize != chunkSize {
+			module.logger().WithFields(log.Fields{
+				"chunkSize": chunkSize, "prevChunkSize": prevChunkSize,
+			}).Warn("Chunk size changed, restart image upload")
+
+			uploadedChunks = 0
+		}
+
+		module.setUploadedChunks(uploadedChunks, chunkSize)
+
+		if uploadedChunks == 0 {
+			if _, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandSyncCompose, nil); err != nil {
+				return err
+			}
+
+			module.setPendingVersion(vendorVersion)
+
+			if err := module.saveState(); err != nil {
+				return err
+			}
+		} else {
+			module.logger().WithFields(log.Fields{
+				"chunk": uploadedChunks,
+			}).Debug("Resume image upload")
+		}
+
+		if _, err := file.Seek(int64(uploadedChunks)*int64(chunkSize), io.SeekStart); err != nil {
+			return newReasonError(ReasonExtractFailed, err)
+		}
+
+		data := make([]byte, chunkSize)
+
+		for {
+			size, err := io.ReadFull(file, data)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return newReasonError(ReasonExtractFailed, err)
+			}
+
+			if err = module.sendChunk(sendMQ, recvMQ, uploadedChunks, data[:size]); err != nil {
+				return err
+			}
+
+			uploadedChunks++
+
+			module.setUploadedChunks(uploadedChunks, chunkSize)
+
+			if err = module.saveState(); err != nil {
+				return err
+			}
+		}
+
+		if module.config.ValidateBeforeDownload {
+			if err := module.validateImage(sendMQ, recvMQ); err != nil {
+				return err
+			}
+		}
+
+		if _, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandDownload, nil); err != nil {
+			return err
+		}
+
+		module.setUploadedChunks(0, 0)
+
+		return nil
+	})
+}
+
+// setUploadedChunks sets number of chunks uploaded to the master and their size.
+func (module *RenesasUpdateModule) setUploadedChunks(uploadedChunks uint32, chunkSize int) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.UploadedChunks, module.ChunkSize = uploadedChunks, chunkSize
+}
+
+// getChunkSize returns size of uploaded chunks. UploadChunkSize is the upper bound and is used as is unless
+// NegotiateChunkSize is set. In this case, the module sends otaCommandGetChunkSize request with uint32 UploadChunkSize
+// and the master responds with uint32 maximum chunk size it can buffer: the smaller of both is used. Zero master
+// chunk size is a protocol error. If the master doesn't support negotiation, UploadChunkSize is used. The result is
+// cached for the module session.
+func (module *RenesasUpdateModule) getChunkSize(sendMQ, recvMQ *posix_mq.MessageQueue) (chunkSize int, err error) {
+	if !module.config.NegotiateChunkSize {
+		return module.config.UploadChunkSize, nil
+	}
+
+	if module.chunkSize != 0 {
+		return module.chunkSize, nil
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err = binary.Write(buffer, module.byteOrder, uint32(module.config.UploadChunkSize)); err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	chunkSize = module.config.UploadChunkSize
+
+	response, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandGetChunkSize, buffer.Bytes())
+	if err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			return 0, err
+		}
+
+		module.logger().Warn("OTA master doesn't support chunk size negotiation, skip")
+	} else {
+		var masterChunkSize uint32
+
+		if err = binary.Read(bytes.NewReader(response), module.byteOrder, &masterChunkSize); err != nil {
+			return 0, newReasonError(ReasonProtocolError, err)
+		}
+
+		if masterChunkSize == 0 {
+			return 0, newReasonError(ReasonProtocolError, aoserrors.New("zero master chunk size"))
+		}
+
+		if int(masterChunkSize) < chunkSize {
+			chunkSize = int(masterChunkSize)
+		}
+	}
+
+	module.logger().WithFields(log.Fields{"chunkSize": chunkSize}).Debug("Chunk size negotiated")
+
+	module.chunkSize = chunkSize
+
+	return chunkSize, nil
+}
+
+func (module *RenesasUpdateModule) sendChunk(
+	sendMQ, recvMQ *posix_mq.MessageQueue, index uint32, data []byte,
+) (err error) {
+	buffer := bytes.NewBuffer(nil)
+
+	if err = binary.Write(buffer, module.byteOrder,
+		[]uint32{index, uint32(len(data)), crc32.ChecksumIEEE(data)}); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	buffer.Write(data)
+
+	for i := 0; i < otaChunkMaxRetries; i++ {
+		if i > 0 {
+			module.updateStats(func(stats *ProtocolStats) { stats.Retries++ })
+		}
+
+		_, err = module.sendOTARequest(sendMQ, recvMQ, otaCommandUploadChunk, buffer.Bytes())
+		if err == nil && module.config.VerifyEachChunk && !module.chunkVerifyUnsupported {
+			err = module.verifyChunk(sendMQ, recvMQ, index, crc32.ChecksumIEEE(data))
+		}
+
+		if !errors.Is(err, ErrChunkCorrupted) {
+			return err
+		}
+
+		module.logger().WithFields(log.Fields{"chunk": index}).Warn("Chunk corrupted, resend")
+	}
+
+	return err
+}
+
+// setMasterVerbose sends otaCommandSetVerbose request with uint32 payload: 1 turns verbose logging on, 0 turns it
+// off. The master responds with uint32 previous setting in the same encoding.
+func (module *RenesasUpdateModule) setMasterVerbose(on bool) (wasOn bool, err error) {
+	var value uint32
+
+	if on {
+		value = 1
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err = binary.Write(buffer, module.byteOrder, value); err != nil {
+		return false, aoserrors.Wrap(err)
+	}
+
+	response, err := module.queryOTAMaster(otaCommandSetVerbose, buffer.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &value); err != nil {
+		return false, newReasonError(ReasonProtocolError, err)
+	}
+
+	return value != 0, nil
+}
+
+// checkMasterConfig compares OTA master configuration with the module configuration and logs mismatches. It doesn't
+// fail Init: the check is intended to detect configuration drift, not to block the module.
+func (module *RenesasUpdateModule) checkMasterConfig() {
+	masterConfig, err := module.GetMasterConfig()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report its configuration, skip")
+		} else {
+			module.logger().Warnf("Can't get OTA master configuration: %v", err)
+		}
+
+		return
+	}
+
+	if targetFile, ok := masterConfig["targetFile"]; ok && targetFile != module.config.TargetFile {
+		module.logger().WithFields(log.Fields{
+			"masterTargetFile": targetFile, "targetFile": module.config.TargetFile,
+		}).Warn("OTA master target file mismatch")
+	}
+}
+
+// enableMasterVerbose turns OTA master verbose logging on and returns function restoring the previous setting.
+// Failures are logged only: verbose logging is a diagnostic aid and doesn't fail the operation.
+func (module *RenesasUpdateModule) enableMasterVerbose() (restore func()) {
+	wasOn, err := module.setMasterVerbose(true)
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't support verbose logging, skip")
+		} else {
+			module.logger().Warnf("Can't enable OTA master verbose logging: %v", err)
+		}
+
+		return func() {}
+	}
+
+	if wasOn {
+		return func() {}
+	}
+
+	return func() {
+		if _, err := module.setMasterVerbose(false); err != nil {
+			module.logger().Warnf("Can't restore OTA master verbose logging: %v", err)
+		}
+	}
+}
+
+// beginTransaction opens OTA master transaction covering prepare and update. The transaction state is persisted, so
+// the transaction opened by prepare is committed by update even after restart. If the transaction is already open
+// (e.g. prepare is retried after failed rollback), it is reused. If the master response is not received (timeout or
+// canceled operation), the master may have opened the transaction, so it is considered open to be rolled back by the
+// caller.
+func (module *RenesasUpdateModule) beginTransaction() error {
+	if module.isTxnOpen() {
+		return nil
+	}
+
+	if _, err := module.queryOTAMaster(otaCommandBeginTxn, nil); err != nil {
+		if errors.Is(err, ErrTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			module.setTxnOpen(true)
+		}
+
+		return err
+	}
+
+	module.setTxnOpen(true)
+
+	return module.saveState()
+}
+
+// commitTransaction commits opened OTA master transaction. Failed commit fails the update and the transaction is
+// rolled back by the caller.
+func (module *RenesasUpdateModule) commitTransaction() error {
+	if !module.isTxnOpen() {
+		return nil
+	}
+
+	if _, err := module.queryOTAMaster(otaCommandCommitTxn, nil); err != nil {
+		return err
+	}
+
+	module.setTxnOpen(false)
+
+	return module.saveState()
+}
+
+// rollbackTransaction rolls back opened OTA master transaction. It is called on error paths, so failures are logged
+// only and the original error is returned to the caller. The transaction is considered closed even if rollback fails:
+// the master is expected to drop uncommitted transaction on its own. The rollback is not bound to the operation
+// context: it is also called when the operation is failed by canceled context or expired deadline.
+func (module *RenesasUpdateModule) rollbackTransaction() {
+	if !module.isTxnOpen() {
+		return
+	}
+
+	ctx := module.operationContext()
+	module.setOperationContext(nil)
+
+	defer module.setOperationContext(ctx)
+
+	if _, err := module.queryOTAMaster(otaCommandRollbackTxn, nil); err != nil {
+		module.logger().Errorf("Can't rollback OTA master transaction: %v", err)
+	}
+
+	module.setTxnOpen(false)
+
+	if err := module.saveState(); err != nil {
+		module.logger().Errorf("Can't save module state: %v", err)
+	}
+}
+
+func (module *RenesasUpdateModule) isTxnOpen() bool {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.TxnOpen
+}
+
+func (module *RenesasUpdateModule) setTxnOpen(open bool) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.TxnOpen = open
+}
+
+// verifyChunk requests the master to verify stored chunk. The request payload is uint32 chunk index followed by uint32
+// CRC32 (IEEE) of chunk data. The master responds with otaStatusChunkCorrupted if the stored chunk doesn't match the
+// CRC. If the master doesn't support chunk verification, it is skipped for the rest of the session.
+func (module *RenesasUpdateModule) verifyChunk(
+	sendMQ, recvMQ *posix_mq.MessageQueue, index uint32, crc uint32,
+) error {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := binary.Write(buffer, module.byteOrder, []uint32{index, crc}); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if _, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandVerifyChunk, buffer.Bytes()); err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		module.logger().Warn("OTA master doesn't support chunk verification, skip")
+
+		module.chunkVerifyUnsupported = true
+	}
+
+	return nil
+}
+
+// negotiateProtocol performs protocol version handshake. The module sends otaCommandNegotiate request with uint32
+// count of supported versions followed by uint32 versions. The master responds with uint32 agreed version which
+// selects wire format used for the rest of the session. If the master doesn't respond in time or doesn't support
+// negotiation (older masters), otaDefaultProtocol is used.
+func (module *RenesasUpdateModule) negotiateProtocol() error {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := binary.Write(buffer, module.byteOrder, uint32(len(otaSupportedProtocols))); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if err := binary.Write(buffer, module.byteOrder, otaSupportedProtocols); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	module.protocol = otaDefaultProtocol
+
+	response, err := module.queryOTAMaster(otaCommandNegotiate, buffer.Bytes())
+	if err != nil {
+		if !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		module.logger().WithFields(log.Fields{
+			"protocol": module.protocol,
+		}).Warnf("OTA master protocol negotiation failed, use default: %v", err)
+
+		return nil
+	}
+
+	var protocol uint32
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &protocol); err != nil {
+		return newReasonError(ReasonProtocolError, err)
+	}
+
+	supported := false
+
+	for _, version := range otaSupportedProtocols {
+		if version == protocol {
+			supported = true
+
+			break
+		}
+	}
+
+	if !supported {
+		return newReasonError(ReasonProtocolError, aoserrors.Errorf("unsupported protocol version: %d", protocol))
+	}
+
+	module.protocol = int(protocol)
+
+	module.logger().WithFields(log.Fields{"protocol": module.protocol}).Info("OTA master protocol negotiated")
+
+	return nil
+}
+
+// checkMasterProtocol checks that OTA master protocol version is within MinMasterProtocol and MaxMasterProtocol.
+// Zero bound is not checked.
+func (module *RenesasUpdateModule) checkMasterProtocol() error {
+	if (module.config.MinMasterProtocol != 0 && module.protocol < module.config.MinMasterProtocol) ||
+		(module.config.MaxMasterProtocol != 0 && module.protocol > module.config.MaxMasterProtocol) {
+		return newReasonError(ReasonProtocolError, aoserrors.Errorf(
+			"OTA master protocol version %d is out of required range [%d, %d]",
+			module.protocol, module.config.MinMasterProtocol, module.config.MaxMasterProtocol))
+	}
+
+	return nil
+}
+
+// confirmActiveVersion checks that OTA master activated the pending version, so the versions are swapped only if the
+// master really switched to the new image.
+func (module *RenesasUpdateModule) confirmActiveVersion() error {
+	activeVersion, err := module.GetActiveVersion()
+	if err != nil {
+		return err
+	}
+
+	if pendingVersion := module.getPendingVersion(); activeVersion != pendingVersion {
+		return newReasonError(ReasonVersionMismatch, aoserrors.Errorf(
+			"active version %s doesn't match pending version %s", activeVersion, pendingVersion))
+	}
+
+	return nil
+}
+
+// checkQueueDepth blocks prepare if OTA master queue depth exceeds MaxMasterQueueDepth. ErrMasterBacklogged is
+// retryable: the orchestrator should retry prepare later when the master processes its queue. The check is skipped if
+// the master doesn't report queue depth.
+func (module *RenesasUpdateModule) checkQueueDepth() error {
+	depth, err := module.GetMasterQueueDepth()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report queue depth, skip")
+
+			return nil
+		}
+
+		return err
+	}
+
+	if depth > module.config.MaxMasterQueueDepth {
+		return newReasonError(ReasonMasterBacklogged, aoserrors.Errorf(
+			"queue depth %d exceeds %d: %w", depth, module.config.MaxMasterQueueDepth, ErrMasterBacklogged))
+	}
+
+	return nil
+}
+
+// checkTemperature blocks update if OTA master temperature exceeds MaxUpdateTemperature. ErrOverheated is retryable:
+// the orchestrator should retry update after the device cools down. The check is skipped if the master doesn't report
+// thermal state.
+func (module *RenesasUpdateModule) checkTemperature() error {
+	state, err := module.GetThermalState()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report thermal state, skip")
+
+			return nil
+		}
+
+		return err
+	}
+
+	module.logger().WithFields(log.Fields{
+		"temperature": state.Temperature, "throttled": state.Throttled,
+	}).Debug("OTA master thermal state")
+
+	if state.Temperature > module.config.MaxUpdateTemperature {
+		return newReasonError(ReasonOverheated, aoserrors.Errorf(
+			"temperature %.1f exceeds %.1f: %w", state.Temperature, module.config.MaxUpdateTemperature, ErrOverheated))
+	}
+
+	return nil
+}
+
+// cleanupOrphans removes temporary target files left by Prepare interrupted by a crash. Target files themselves are
+// never removed: they are replaced only by a completely extracted image, so they may hold a prepared image or an
+// image extracted for resume. Only files older than OrphanMaxAge are removed.
+func (module *RenesasUpdateModule) cleanupOrphans() {
+	for _, targetFile := range module.targetFiles() {
+		orphan := module.tmpTargetFile(targetFile)
+
+		info, err := os.Stat(orphan)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if module.clock.Now().Sub(info.ModTime()) < module.config.OrphanMaxAge.Duration {
+			continue
+		}
+
+		module.logger().WithFields(log.Fields{"file": orphan}).Info("Remove orphaned file")
+
+		if err = os.Remove(orphan); err != nil {
+			module.logger().WithFields(log.Fields{"file": orphan}).Errorf("Can't remove orphaned file: %v", err)
+		}
+	}
+}
+
+func (module *RenesasUpdateModule) checkReady() error {
+	if err := module.CheckQueues(); err != nil {
+		return err
+	}
+
+	state, err := module.storage.GetModuleState(module.id)
+	if err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if len(state) > 0 {
+		// Integrity check is always strict here: not strict mode only lets the module start in idle state, the module
+		// shouldn't be reported as ready while the persisted state is tampered.
+		persisted := &RenesasUpdateModule{config: module.config}
+		persisted.config.StrictStateIntegrity = true
+
+		if err = persisted.loadState(state); err != nil {
+			return err
+		}
+	}
+
+	if state := module.getState(); state < idleState || state > failedState {
+		return aoserrors.Errorf("unknown module state: %d", state)
+	}
+
+	// Temporary target file is expected while an operation extracts the image, it is orphaned only if no operation is
+	// running.
+	if module.CurrentOperationID() != "" {
+		return nil
+	}
+
+	for _, targetFile := range module.targetFiles() {
+		if _, err = os.Stat(module.tmpTargetFile(targetFile)); err == nil {
+			return aoserrors.New("orphaned temporary target file found")
+		}
+	}
+
+	return nil
+}
+
+// tmpTargetFile returns path of temporary file in the module work directory the target file is extracted to.
+func (module *RenesasUpdateModule) tmpTargetFile(targetFile string) string {
+	return filepath.Join(module.config.WorkDir, filepath.Base(targetFile)+".tmp")
+}
+
+// checkVersionScheme checks that vendor version matches VersionScheme: semantic version (semver, default) or any
+// non empty string (none).
+func (module *RenesasUpdateModule) checkVersionScheme(vendorVersion string) error {
+	if vendorVersion == "" {
+		return aoserrors.New("vendor version is empty")
+	}
+
+	if module.config.VersionScheme == versionSchemeSemver && !semverRegexp.MatchString(vendorVersion) {
+		return aoserrors.Errorf("vendor version %s is not a valid semantic version", vendorVersion)
+	}
+
+	return nil
+}
+
+// isVersionAllowed checks vendor version against AllowedVersions. Empty list allows any version.
+func (module *RenesasUpdateModule) isVersionAllowed(vendorVersion string) bool {
+	if len(module.config.AllowedVersions) == 0 {
+		return true
+	}
+
+	for _, version := range module.config.AllowedVersions {
+		if version == vendorVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purgeMaster purges OTA master and resets module state to idle. Staged target files are removed, block device targets
+// are kept (see removeTargetFile).
+func (module *RenesasUpdateModule) purgeMaster() error {
+	if _, err := module.queryOTAMaster(otaCommandPurge, nil); err != nil {
+		return err
+	}
+
+	module.logger().WithFields(log.Fields{
+		"state": module.getState(), "pendingVersion": module.getPendingVersion(),
+	}).Warn("OTA master purged, module state reset")
+
+	if err := module.removeTargets(); err != nil {
+		return err
+	}
+
+	module.setPendingVersion("")
+	module.setUploadedChunks(0, 0)
+	module.setTxnOpen(false)
+
+	return module.setState(idleState)
+}
+
+// removeTargets removes target files of the module with removeTargetFile. All targets are removed even if some fail,
+// the first error is returned.
+func (module *RenesasUpdateModule) removeTargets() (err error) {
+	for _, targetFile := range module.targetFiles() {
+		if removeErr := removeTargetFile(targetFile); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+
+	return err
+}
+
+// discardPrepared asks the master to discard downloaded image and removes staged target files. Block device targets
+// are kept (see removeTargetFile).
+func (module *RenesasUpdateModule) discardPrepared() error {
+	if err := module.sendOTACommands(otaCommandDiscard); err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		module.logger().Warn("OTA master doesn't support image discard, skip")
+	}
+
+	if err := module.removeTargets(); err != nil {
+		return err
+	}
+
+	module.setUploadedChunks(0, 0)
+
+	return nil
+}
+
+// extractTarget extracts image to the target file and persists the extracted image marker. If prepare is interrupted
+// after extraction (e.g. download command fails or the module restarts), the next prepare of the same image and version
+// skips extraction if the target file is not changed (see isImageExtracted) and only resends OTA master commands.
+func (module *RenesasUpdateModule) extractTarget(
+	imagePath, sourcePath, vendorVersion string, annotations json.RawMessage,
+) error {
+	var imageSize uint64
+
+	if module.config.DailyWriteBudget > 0 {
+		var err error
+
+		if imageSize, err = module.getImageSize(imagePath); err != nil {
+			return newReasonError(ReasonExtractFailed, err)
+		}
+
+		if err = module.checkWriteBudget(imageSize, annotations); err != nil {
+			return err
+		}
+	}
+
+	module.reportProgress(ProgressPhaseExtract, 0)
+
+	extractStart := module.clock.Now()
+
+	if err := module.extractVerifiedImage(imagePath, module.primaryTarget(), annotations); err != nil {
+		return err
+	}
+
+	module.addPhaseTiming(phaseExtract, module.clock.Now().Sub(extractStart))
+
+	checksum, err := getFileChecksum(module.primaryTarget())
+	if err != nil {
+		return newReasonError(ReasonIOError, err)
+	}
+
+	module.stateMutex.Lock()
+	module.ExtractedImage = &extractedImage{Source: sourcePath, Version: vendorVersion, SHA256: checksum}
+	module.stateMutex.Unlock()
+
+	return module.saveState()
+}
+
+// isImageExtracted checks that the target files contain image extracted by interrupted prepare of the same source
+// image and vendor version and are not modified since then.
+func (module *RenesasUpdateModule) isImageExtracted(sourcePath, vendorVersion string) bool {
+	module.stateMutex.Lock()
+	extracted := module.ExtractedImage
+	module.stateMutex.Unlock()
+
+	if extracted == nil || extracted.Source != sourcePath || extracted.Version != vendorVersion {
+		return false
+	}
+
+	checksums := extracted.Targets
+
+	if checksums == nil {
+		checksums = map[string]string{module.primaryTarget(): extracted.SHA256}
+	}
+
+	if len(checksums) != len(module.targetFiles()) {
+		return false
+	}
+
+	for _, targetFile := range module.targetFiles() {
+		expected, ok := checksums[targetFile]
+		if !ok {
+			return false
+		}
+
+		checksum, err := getFileChecksum(targetFile)
+		if err != nil {
+			module.logger().Debugf("Can't get extracted image checksum: %v", err)
+
+			return false
+		}
+
+		if checksum != expected {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extractTargets extracts images of multiple target files. The image path should be a directory containing an image per
+// target file, named as the base name of the target file. Each extracted target is verified against annotated target
+// checksums and re-extracted on mismatch like a single image (see extractVerifiedImage); image checksum and size
+// annotations apply to a single image and are not used. Daily write budget is checked for all images together. All
+// targets are processed even if some fail, so on failure all target files are removed and TargetsError with status of
+// each target is returned. On success, the extracted image marker with checksum of each target is persisted.
+func (module *RenesasUpdateModule) extractTargets(
+	imagePath, sourcePath, vendorVersion string, annotations json.RawMessage,
+) error {
+	var prepareInfo prepareAnnotations
+
+	if len(annotations) != 0 {
+		if err := json.Unmarshal(annotations, &prepareInfo); err != nil {
+			return aoserrors.Wrap(err)
+		}
+	}
+
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return extractError(imagePath, err)
+	}
+
+	if !info.IsDir() {
+		return newReasonError(ReasonExtractFailed,
+			aoserrors.Errorf("image path %s should be a directory for multiple target files", imagePath))
+	}
+
+	var imageSize uint64
+
+	if module.config.DailyWriteBudget > 0 {
+		for _, targetFile := range module.config.TargetFiles {
+			var size uint64
+
+			if size, err = module.getImageSize(filepath.Join(imagePath, filepath.Base(targetFile))); err != nil {
+				return newReasonError(ReasonExtractFailed, err)
+			}
+
+			imageSize += size
+		}
+
+		if err = module.checkWriteBudget(imageSize, annotations); err != nil {
+			return err
+		}
+	}
+
+	module.reportProgress(ProgressPhaseExtract, 0)
+
+	extractStart := module.clock.Now()
+	targetsErr := &TargetsError{}
+	checksums := make(map[string]string)
+
+	for _, targetFile := range module.config.TargetFiles {
+		var targetAnnotations json.RawMessage
+
+		// Annotated target checksum is verified as checksum of single extracted image.
+		if checksum, ok := prepareInfo.Checksums[targetFile]; ok {
+			if targetAnnotations, err = json.Marshal(prepareAnnotations{SHA256: checksum}); err != nil {
+				return aoserrors.Wrap(err)
+			}
+		}
+
+		targetErr := module.extractVerifiedImage(
+			filepath.Join(imagePath, filepath.Base(targetFile)), targetFile, targetAnnotations)
+		if targetErr == nil {
+			if checksums[targetFile], targetErr = getFileChecksum(targetFile); targetErr != nil {
+				targetErr = newReasonError(ReasonIOError, targetErr)
+			}
+		}
+
+		if targetErr != nil && targetsErr.err == nil {
+			targetsErr.err = targetErr
+		}
+
+		targetsErr.Targets = append(targetsErr.Targets, TargetStatus{File: targetFile, Err: targetErr})
+	}
+
+	module.addPhaseTiming(phaseExtract, module.clock.Now().Sub(extractStart))
+
+	if targetsErr.err != nil {
+		if err = module.removeTargets(); err != nil {
+			module.logger().Errorf("Can't remove target files: %v", err)
+		}
+
+		return targetsErr
+	}
+
+	module.stateMutex.Lock()
+	module.ExtractedImage = &extractedImage{Source: sourcePath, Version: vendorVersion, Targets: checksums}
+	module.stateMutex.Unlock()
+
+	return module.saveState()
+}
+
+// extractVerifiedImage extracts image and, if the extracted image doesn't match annotated checksums, re-extracts it
+// from the source image up to RetryOnChecksumMismatch times. It allows to recover from transient decompression or IO
+// glitches: each attempt fully re-extracts the image, nothing is kept between attempts. If the source image itself is
+// bad, all attempts fail and the last checksum mismatch error is returned.
+func (module *RenesasUpdateModule) extractVerifiedImage(
+	imagePath, targetFile string, annotations json.RawMessage,
+) (err error) {
+	for i := 0; ; i++ {
+		if err = module.extractImage(imagePath, targetFile, annotations); err == nil ||
+			i >= module.config.RetryOnChecksumMismatch || ErrorCode(err) != ReasonChecksumMismatch {
+			return err
+		}
+
+		module.logger().WithFields(log.Fields{"attempt": i + 1}).Warnf("Extracted image mismatch, retry: %v", err)
+	}
+}
+
+func (module *RenesasUpdateModule) extractImage(imagePath, targetFile string, annotations json.RawMessage) error {
+	release := acquireExtraction()
+	defer release()
+
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0o700); err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+
+	if module.config.GuardActiveTarget {
+		unlock, err := lockTarget(targetFile)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := os.Stat(imagePath); err != nil {
+		return extractError(targetFile, err)
+	}
+
+	compression, err := module.imageCompression(imagePath)
+	if err != nil {
+		return extractError(targetFile, err)
+	}
+
+	if err = module.checkTargetSpace(imagePath, targetFile, compression, annotations); err != nil {
+		return err
+	}
+
+	// Regular target file is replaced only by a completely extracted image: the image is extracted into temporary file
+	// which is renamed to the target file on success. Other targets (e.g. block devices) are written in place.
+	extractFile := targetFile
+
+	if info, err := os.Stat(targetFile); err != nil || info.Mode().IsRegular() {
+		extractFile = module.tmpTargetFile(targetFile)
+
+		defer func() {
+			if err := os.Remove(extractFile); err != nil && !os.IsNotExist(err) {
+				module.logger().WithField("file", extractFile).Errorf("Can't remove temporary target file: %v", err)
+			}
+		}()
+	}
+
+	file, err := os.Create(extractFile)
+	if err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+	file.Close()
+
+	written, err := copyFromArchive(extractFile, imagePath, compression)
+
+	module.chargeWriteBudget(written)
+
+	if err != nil {
+		return extractError(targetFile, err)
+	}
+
+	if extractFile != targetFile {
+		if err = replaceFile(targetFile, extractFile); err != nil {
+			return newReasonError(ReasonIOError, err)
+		}
+	}
+
+	module.logger().WithFields(log.Fields{"size": written, "compression": compression}).Debug("Image extracted")
+
+	if err = verifyImage(targetFile, written, annotations); err != nil {
+		return err
+	}
+
+	return verifyTargets([]string{targetFile}, annotations)
+}
+
+// fetchImage downloads remote image into a temporary directory and returns path of the downloaded image. The download
+// is bound to the operation context limited by RemoteImageTimeout. If annotations contain image checksum, the
+// downloaded image is verified against it. The directory is removed on error.
+func (module *RenesasUpdateModule) fetchImage(
+	imageURL string, annotations json.RawMessage,
+) (imagePath string, err error) {
+	if !module.config.AllowRemoteImages {
+		return "", aoserrors.Errorf("remote images are not allowed: %s", imageURL)
+	}
+
+	var prepareInfo prepareAnnotations
+
+	if len(annotations) != 0 {
+		if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+			return "", aoserrors.Wrap(err)
+		}
+	}
+
+	fetchDir, err := ioutil.TempDir(module.config.WorkDir, "fetch")
+	if err != nil {
+		return "", newReasonError(ReasonIOError, err)
+	}
+
+	defer func() {
+		if err != nil {
+			if removeErr := os.RemoveAll(fetchDir); removeErr != nil {
+				log.WithField("dir", fetchDir).Errorf("Can't remove fetch directory: %v", removeErr)
+			}
+		}
+	}()
+
+	ctx := module.operationContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, module.config.RemoteImageTimeout.Duration)
+	defer cancel()
+
+	fileName, err := downloadImage(ctx, fetchDir, imageURL)
+	if err != nil {
+		return "", newReasonError(ReasonFetchFailed, err)
+	}
+
+	if prepareInfo.ImageChecksum == "" {
+		return fileName, nil
+	}
+
+	checksum, err := getFileChecksum(fileName)
+	if err != nil {
+		return "", newReasonError(ReasonIOError, err)
+	}
+
+	if !strings.EqualFold(checksum, prepareInfo.ImageChecksum) {
+		return "", newReasonError(ReasonChecksumMismatch,
+			aoserrors.Errorf("remote image %s checksum mismatch: %w", imageURL, ErrVerificationFailed))
+	}
+
+	return fileName, nil
+}
+
+// checkTargetSpace checks that the file system the image is extracted to (see tmpTargetFile) has enough space for the
+// extracted image. The image size is taken from annotations or, if not annotated, estimated from the image (see
+// getImageSize). Space occupied by the existing target file is not counted as available: the target is replaced only
+// after the image is completely extracted. The check is skipped if the target is not a regular file (e.g. block
+// device) or the image size can't be estimated.
+func (module *RenesasUpdateModule) checkTargetSpace(
+	imagePath, targetFile, compression string, annotations json.RawMessage,
+) error {
+	info, err := os.Stat(targetFile)
+	if err == nil && !info.Mode().IsRegular() {
+		return nil
+	}
+
+	var prepareInfo prepareAnnotations
+
+	if len(annotations) != 0 {
+		if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+			return aoserrors.Wrap(err)
+		}
+	}
+
+	required := uint64(prepareInfo.Size)
+
+	if required == 0 {
+		if required, err = imageSize(imagePath, compression); err != nil {
+			module.logger().Warnf("Can't estimate image size, skip free space check: %v", err)
+
+			return nil
+		}
+	}
+
+	var stat syscall.Statfs_t
+
+	if err = syscall.Statfs(filepath.Dir(module.tmpTargetFile(targetFile)), &stat); err != nil {
+		return newReasonError(ReasonIOError, err)
+	}
+
+	available := stat.Bavail * uint64(stat.Bsize)
+
+	if required > available {
+		return newReasonError(ReasonInsufficientSpace, aoserrors.Errorf(
+			"not enough space to extract image: required %d bytes, available %d bytes", required, available))
+	}
+
+	return nil
+}
+
+// imageCompression returns image compression detected by magic bytes. It is the only place where image compression is
+// resolved: extraction, size estimation and early validation use its result. If the detected compression differs from
+// the configured one, warning is logged and the detected compression is used. Images without known magic bytes (e.g.
+// raw images) use configured compression or gzip if Compression is not configured. Detected compression which can't
+// be extracted (e.g. xz) is rejected.
+func (module *RenesasUpdateModule) imageCompression(imagePath string) (compression string, err error) {
+	if compression, err = detectCompression(imagePath); err != nil {
+		return "", newReasonError(ReasonExtractFailed, err)
+	}
+
+	switch compression {
+	case "", compressionGzip, compressionZstd:
+
+	default:
+		return "", newReasonError(ReasonExtractFailed, aoserrors.Errorf("unsupported image compression: %s", compression))
+	}
+
+	if compression == "" {
+		if module.config.Compression == "" {
+			return compressionGzip, nil
+		}
+
+		return module.config.Compression, nil
+	}
+
+	if module.config.Compression != "" && module.config.Compression != compression {
+		module.logger().WithFields(log.Fields{
+			"configured": module.config.Compression, "detected": compression,
+		}).Warn("Image compression differs from configured one, use detected compression")
+	}
+
+	return compression, nil
+}
+
+// getImageSize returns uncompressed image size: ISIZE field of gzip trailer, frame content size of zstd header or
+// file size of raw image. If zstd header doesn't contain content size, the image is decompressed to count its size.
+func (module *RenesasUpdateModule) getImageSize(imagePath string) (size uint64, err error) {
+	compression, err := module.imageCompression(imagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return imageSize(imagePath, compression)
+}
+
+// chargeWriteBudget adds bytes written by an extraction attempt to the daily write budget. Each attempt is charged,
+// including failed and retried ones, as the storage is worn regardless of the attempt result.
+func (module *RenesasUpdateModule) chargeWriteBudget(written int64) {
+	if module.config.DailyWriteBudget == 0 || written <= 0 {
+		return
+	}
+
+	module.stateMutex.Lock()
+	module.WrittenBytes += uint64(written)
+	module.stateMutex.Unlock()
+
+	if err := module.saveState(); err != nil {
+		module.logger().Errorf("Can't save module state: %v", err)
+	}
+}
+
+// checkWriteBudget checks that extraction of image of the given size doesn't exceed daily write budget. Written bytes
+// counter is reset when a day has passed since the first write of the current budget day.
+func (module *RenesasUpdateModule) checkWriteBudget(imageSize uint64, annotations json.RawMessage) (err error) {
+	now := module.clock.Now()
+
+	module.stateMutex.Lock()
+
+	if now.Sub(module.WriteDayStart) >= 24*time.Hour {
+		module.WriteDayStart = now
+		module.WrittenBytes = 0
+	}
+
+	written := module.WrittenBytes
+
+	module.stateMutex.Unlock()
+
+	if written+imageSize <= module.config.DailyWriteBudget {
+		return nil
+	}
+
+	var prepareInfo prepareAnnotations
+
+	if len(annotations) != 0 {
+		if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+			return aoserrors.Wrap(err)
+		}
+	}
+
+	if prepareInfo.IgnoreWriteBudget {
+		module.logger().WithFields(log.Fields{
+			"written": written, "budget": module.config.DailyWriteBudget,
+		}).Warn("Daily write budget exceeded, ignored by annotation")
+
+		return nil
+	}
+
+	return newReasonError(ReasonWriteBudgetExceeded, aoserrors.Errorf(
+		"image size %d exceeds daily write budget, written %d of %d bytes: %w",
+		imageSize, written, module.config.DailyWriteBudget, ErrWriteBudgetExceeded))
+}
+
+// preallocateOnMaster requests the master to reserve space for the extracted image. The request payload is uint64
+// target file size. The master responds with otaStatusNoSpace if the space can't be reserved.
+func (module *RenesasUpdateModule) preallocateOnMaster() error {
+	info, err := os.Stat(module.primaryTarget())
+	if err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err = binary.Write(buffer, module.byteOrder, uint64(info.Size())); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if _, err = module.queryOTAMaster(otaCommandPreallocate, buffer.Bytes()); err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't support preallocation, skip")
+
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// preservePreviousSlot requests the master to keep the currently booted slot when the new image is downloaded, so
+// Revert always has a target. Masters that always preserve the previous slot acknowledge the command as no-op. If the
+// master doesn't support the command, it is skipped with warning: such master may recycle the previous slot for the
+// new image (e.g. when it is short of space) and Revert fails after the slot is erased.
+func (module *RenesasUpdateModule) preservePreviousSlot() error {
+	if _, err := module.queryOTAMaster(otaCommandPreservePrevious, nil); err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't support previous slot preservation, skip")
+
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// getMasterState returns OTA master update state. The master responds with uint32 state: otaMasterStateIdle,
+// otaMasterStateReady (image downloaded and ready to install), otaMasterStateInstalled or otaMasterStateActivated.
+func (module *RenesasUpdateModule) getMasterState() (state uint32, err error) {
+	response, err := module.queryOTAMaster(otaCommandGetMasterState, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &state); err != nil {
+		return 0, newReasonError(ReasonProtocolError, err)
+	}
+
+	return state, nil
+}
+
+// reconcileState corrects module state according to OTA master state after restart:
+//
+//	prepared, master idle      -> idle: prepared image is lost
+//	prepared, master activated -> updated: update was completed before restart
+//	updated, master ready      -> prepared: image was not activated
+//
+// Reconciliation is skipped if the master doesn't report its state.
+func (module *RenesasUpdateModule) reconcileState() error {
+	masterState, err := module.getMasterState()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report its state, skip reconciliation")
+
+			return nil
+		}
+
+		return err
+	}
+
+	state := module.getState()
+	newState := state
+
+	switch {
+	case state == preparedState && masterState == otaMasterStateIdle:
+		newState = idleState
+
+	case state == preparedState && masterState == otaMasterStateActivated:
+		newState = updatedState
+
+		module.swapVersions()
+		module.incrementUpdateCount()
+
+	case state == updatedState && masterState == otaMasterStateReady:
+		newState = preparedState
+
+		module.swapVersions()
+	}
+
+	if newState == state {
+		return nil
+	}
+
+	module.logger().WithFields(log.Fields{
+		"state": state, "newState": newState, "masterState": masterState,
+	}).Warn("Module state corrected according to OTA master state")
+
+	return module.setState(newState)
+}
+
+// reconcileVendorVersion corrects vendor version according to the version of the module component installed on OTA
+// master. The version may change out of band, e.g. by manual flashing. Reconciliation is skipped if the master doesn't
+// report installed versions or doesn't know the module component.
+func (module *RenesasUpdateModule) reconcileVendorVersion() error {
+	versions, err := module.GetMasterComponentVersions()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report component versions, skip reconciliation")
+
+			return nil
+		}
+
+		return err
+	}
+
+	module.stateMutex.Lock()
+	vendorVersion := module.VendorVersion
+	module.stateMutex.Unlock()
+
+	version, ok := versions[module.id]
+	if !ok || version == vendorVersion {
+		return nil
+	}
+
+	module.logger().WithFields(log.Fields{
+		"vendorVersion": vendorVersion, "masterVersion": version,
+	}).Warn("Vendor version corrected according to OTA master")
+
+	module.stateMutex.Lock()
+	module.VendorVersion = version
+	module.stateMutex.Unlock()
+
+	return module.saveState()
+}
+
+// readString reads uint16 length prefixed string of OTA master response.
+func (module *RenesasUpdateModule) readString(reader *bytes.Reader) (value string, err error) {
+	var length uint16
+
+	if err = binary.Read(reader, module.byteOrder, &length); err != nil {
+		return "", newReasonError(ReasonProtocolError, err)
+	}
+
+	if int(length) > reader.Len() {
+		return "", newReasonError(ReasonProtocolError,
+			aoserrors.Errorf("string length %d exceeds response size", length))
+	}
+
+	data := make([]byte, length)
+
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return "", newReasonError(ReasonProtocolError, err)
+	}
+
+	return string(data), nil
+}
+
+func (module *RenesasUpdateModule) getLiveVendorVersion() (string, error) {
+	version, err := module.GetActiveVersion()
+
+	module.stateMutex.Lock()
+	cachedVersion := module.VendorVersion
+	module.stateMutex.Unlock()
+
+	if err != nil {
+		if !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrUnsupported) {
+			return "", err
+		}
+
+		module.logger().Warnf("Can't get live vendor version, use cached one: %v", err)
+
+		return cachedVersion, nil
+	}
+
+	if version == cachedVersion {
+		return version, nil
+	}
+
+	module.logger().WithFields(log.Fields{
+		"vendorVersion": cachedVersion, "liveVersion": version,
+	}).Warn("Vendor version updated according to OTA master")
+
+	// The getter doesn't write the storage: the corrected version is persisted by the next operation or on Close.
+	module.stateMutex.Lock()
+	module.VendorVersion = version
+	module.stateDirty = true
+	module.stateMutex.Unlock()
+
+	return version, nil
+}
+
+func (module *RenesasUpdateModule) getRebootRequestedAt() time.Time {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	return module.RebootRequestedAt
+}
+
+func (module *RenesasUpdateModule) setRebootRequestedAt(requestedAt time.Time) error {
+	module.stateMutex.Lock()
+	module.RebootRequestedAt = requestedAt
+	module.stateMutex.Unlock()
+
+	if err := module.saveState(); err != nil {
+		return err
+	}
+
+	return module.flushState()
+}
+
+// confirmReboot checks that the system has booted after the reboot requested by Reboot. The boot time is computed as
+// the current module clock time minus the system uptime reported by sysinfo (the same source as /proc/uptime, with
+// one second resolution). If no reboot is detected, e.g. the reboot command silently failed, a warning is logged and,
+// if FailUnconfirmedReboot is set, ErrRebootNotConfirmed is returned. The request time is cleared in any case.
+func (module *RenesasUpdateModule) confirmReboot() error {
+	requestedAt := module.getRebootRequestedAt()
+
+	if err := module.setRebootRequestedAt(time.Time{}); err != nil {
+		return err
+	}
+
+	var info syscall.Sysinfo_t
+
+	if err := syscall.Sysinfo(&info); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	bootTime := module.clock.Now().Add(-time.Duration(info.Uptime) * time.Second)
+
+	if bootTime.After(requestedAt) {
+		module.logger().WithFields(log.Fields{"bootTime": bootTime}).Debug("Reboot confirmed")
+
+		return nil
+	}
+
+	module.logger().WithFields(log.Fields{
+		"requestedAt": requestedAt, "bootTime": bootTime,
+	}).Warn("Requested reboot didn't happen")
+
+	if module.config.FailUnconfirmedReboot {
+		return aoserrors.Wrap(ErrRebootNotConfirmed)
+	}
+
+	return nil
+}
+
+// verifyMasterReady checks that OTA master is ready to install downloaded image.
+func (module *RenesasUpdateModule) verifyMasterReady() error {
+	state, err := module.getMasterState()
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't report its state, skip")
+
+			return nil
+		}
+
+		return err
+	}
+
+	if state != otaMasterStateReady {
+		return newReasonError(ReasonMasterNotReady,
+			aoserrors.Errorf("OTA master is not ready to install, state: %d", state))
+	}
+
+	return nil
+}
+
+// installImage installs and activates prepared image.
+func (module *RenesasUpdateModule) installImage() error {
+	if err := module.sendOTACommands(otaCommandInstall); err != nil {
+		return err
+	}
+
+	// Flush is sent between install and activate: the master must not switch to the new image until it is
+	// committed to flash.
+	if module.config.FlushAfterInstall {
+		if err := module.sendOTACommands(otaCommandFlush); err != nil {
+			if !errors.Is(err, ErrUnsupported) {
+				return err
+			}
+
+			module.logger().Warn("OTA master doesn't support write cache flush, skip")
+		}
+	}
+
+	module.reportProgress(ProgressPhaseActivate, 60)
+
+	return module.sendOTACommands(otaCommandActivate)
+}
+
+// downloadImage requests the master to download target file. If ValidateBeforeDownload is set, the master validates
+// the staged file before download, so an invalid image doesn't consume master storage.
+func (module *RenesasUpdateModule) downloadImage() error {
+	if !module.config.ValidateBeforeDownload {
+		return module.sendOTACommands(otaCommandSyncCompose, otaCommandDownload)
+	}
+
+	if err := module.sendOTACommands(otaCommandSyncCompose); err != nil {
+		return err
+	}
+
+	if err := module.withOTAQueues(module.validateImage); err != nil {
+		return err
+	}
+
+	return module.sendOTACommands(otaCommandDownload)
+}
+
+// downloadTargets sends download command for each target file (or the target overridden by annotations) after sync
+// compose. The download command payload is the target file path, so the master knows which component to download.
+// Activation follows all downloads.
+func (module *RenesasUpdateModule) downloadTargets() error {
+	if err := module.sendOTACommands(otaCommandSyncCompose); err != nil {
+		return err
+	}
+
+	return module.withOTAQueues(func(sendMQ, recvMQ *posix_mq.MessageQueue) error {
+		for _, targetFile := range module.targetFiles() {
+			if _, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandDownload, []byte(targetFile)); err != nil {
+				return aoserrors.Errorf("download %s failed: %w", targetFile, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// validateImage requests the master to validate staged image header and signature. On failure the master responds
+// with the failure reason text as payload.
+func (module *RenesasUpdateModule) validateImage(sendMQ, recvMQ *posix_mq.MessageQueue) error {
+	response, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandValidate, nil)
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't support image validation, skip")
+
+			return nil
+		}
+
+		if errors.Is(err, ErrVerificationFailed) {
+			return newReasonError(ReasonValidationFailed,
+				aoserrors.Errorf("master image validation failed: %s: %w", string(response), err))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// verifyMasterSignature requests the master to verify signature of the downloaded image. This check is performed in
+// addition to the image signature verification done by the update manager before Prepare and leverages hardware-backed
+// keys of the master. On failure the master responds with the failure reason text as payload and prepare is aborted
+// before install.
+func (module *RenesasUpdateModule) verifyMasterSignature() error {
+	response, err := module.queryOTAMaster(otaCommandVerifySignature, nil)
+	if err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			module.logger().Warn("OTA master doesn't support signature verification, skip")
+
+			return nil
+		}
+
+		if errors.Is(err, ErrVerificationFailed) {
+			return newReasonError(ReasonSignatureInvalid,
+				aoserrors.Errorf("master signature verification failed: %s: %w", string(response), err))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// sendOTACommands sends commands one by one. The master may append uint8 reboot required flag to otaCommandActivate
+// status: non zero value means the activated component requires reboot. The flag is not expected if response validator
+// is set, as the response is not parsed by the module in this case.
+func (module *RenesasUpdateModule) sendOTACommands(commands ...int64) error {
+	return module.withOTAQueues(func(sendMQ, recvMQ *posix_mq.MessageQueue) error {
+		for _, command := range commands {
+			if err := module.drainStaleResponses(recvMQ); err != nil {
+				return err
+			}
+
+			module.emitEvent(Event{Type: EventCommandSent, Command: commandName(command)})
+			module.metrics.CommandSent(module.id, commandName(command))
+
+			start := module.clock.Now()
+
+			response, err := module.sendOTARequest(sendMQ, recvMQ, command, nil)
+
+			module.emitEvent(Event{Type: EventCommandAcknowledged, Command: commandName(command), Err: err})
+
+			if err != nil {
+				module.metrics.CommandFailed(module.id, commandName(command), module.clock.Now().Sub(start))
+
+				return err
+			}
+
+			module.metrics.CommandSucceeded(module.id, commandName(command), module.clock.Now().Sub(start))
+
+			module.batchAcknowledged++
+
+			if command == otaCommandActivate && module.validator == nil {
+				module.setRebootRequired(len(response) > 0 && response[0] != 0)
+			}
+		}
+
+		if module.config.ReconcileBatchCount {
+			return module.reconcileCommandCount(sendMQ, recvMQ, len(commands))
+		}
+
+		return nil
+	})
+}
+
+// drainStaleResponses discards frames left in the receive queue, e.g. status of the command sent before the module
+// was restarted. Otherwise the stale status would be attributed to the next command.
+func (module *RenesasUpdateModule) drainStaleResponses(recvMQ *posix_mq.MessageQueue) error {
+	discarded := 0
+
+	for {
+		if _, _, err := recvMQ.TimedReceive(time.Now()); err != nil {
+			if !errors.Is(err, syscall.ETIMEDOUT) {
+				return newReasonError(ReasonQueueUnavailable, err)
+			}
+
+			break
+		}
+
+		discarded++
+	}
+
+	if discarded > 0 {
+		module.logger().WithFields(log.Fields{"count": discarded}).Warn("Stale OTA master frames discarded")
+	}
+
+	return nil
+}
+
+// reconcileCommandCount checks that the master processed all commands of the batch. The master responds to
+// otaCommandGetCommandCount with uint64 number of commands processed since the previous count request (the count
+// request itself is not counted) and resets the counter. Mismatch means that some commands were lost and the batch
+// fails with ErrCommandLost.
+func (module *RenesasUpdateModule) reconcileCommandCount(sendMQ, recvMQ *posix_mq.MessageQueue, sent int) error {
+	response, err := module.sendOTARequest(sendMQ, recvMQ, otaCommandGetCommandCount, nil)
+	if err != nil {
+		return err
+	}
+
+	var processed uint64
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &processed); err != nil {
+		return newReasonError(ReasonProtocolError, err)
+	}
+
+	if processed != uint64(sent) {
+		return newReasonError(ReasonCommandLost, aoserrors.Errorf(
+			"OTA master processed %d of %d commands: %w", processed, sent, ErrCommandLost))
+	}
+
+	return nil
+}
+
+func (module *RenesasUpdateModule) queryOTAMaster(command int64, payload []byte) (response []byte, err error) {
+	err = module.withOTAQueues(func(sendMQ, recvMQ *posix_mq.MessageQueue) error {
+		response, err = module.sendOTARequest(sendMQ, recvMQ, command, payload)
+
+		return err
+	})
+
+	return response, err
+}
+
+func (module *RenesasUpdateModule) queryOTAMasterUint64(command int64) (value uint64, err error) {
+	response, err := module.queryOTAMaster(command, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = binary.Read(bytes.NewReader(response), module.byteOrder, &value); err != nil {
+		return 0, newReasonError(ReasonProtocolError, err)
+	}
+
+	return value, nil
+}
+
+// withOTAQueues calls handler with OTA master queues. The queues are opened once (in Init or on first use) and reused
+// until Close. If the handler fails with queue error (e.g. the master re-created the queues), the queues are reopened
+// and the handler is called once again. The handler has exclusive access to the queues (see ipcMutex), so it must not
+// call withOTAQueues itself.
+func (module *RenesasUpdateModule) withOTAQueues(handler func(sendMQ, recvMQ *posix_mq.MessageQueue) error) error {
+	module.ipcMutex.Lock()
+	defer module.ipcMutex.Unlock()
+
+	sendMQ, recvMQ, err := module.connectQueues()
+	if err != nil {
+		return err
+	}
+
+	if err = handler(sendMQ, recvMQ); ErrorCode(err) != ReasonQueueUnavailable {
+		return err
+	}
+
+	module.logger().Warnf("OTA master queue error, reconnect: %v", err)
+
+	module.disconnectQueues()
+
+	if sendMQ, recvMQ, err = module.connectQueues(); err != nil {
+		return err
+	}
+
+	return handler(sendMQ, recvMQ)
+}
+
+// isMasterDisconnected checks if OTA master request failed because the master is disconnected (e.g. the master daemon
+// is restarted). It is a queue error or a timeout if the master queues don't exist anymore: the module may wait for
+// the response on already unlinked queue. Timeout with existing queues is considered the master failure.
+func (module *RenesasUpdateModule) isMasterDisconnected(err error) bool {
+	if ErrorCode(err) == ReasonQueueUnavailable {
+		return true
+	}
+
+	if !errors.Is(err, ErrTimeout) {
+		return false
+	}
+
+	return module.CheckQueues() != nil
+}
+
+// waitQueues closes module queues and waits up to QueueOpenTimeout until OTA master queues can be opened again.
+func (module *RenesasUpdateModule) waitQueues() error {
+	module.disconnectQueues()
+
+	ctx := module.operationContext()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	deadline := module.clock.After(module.config.QueueOpenTimeout.Duration)
+
+	for {
+		if _, _, err := module.connectQueues(); err == nil {
+			return nil
+		}
+
+		select {
+		case <-module.clock.After(otaCancelPollInterval):
+
+		case <-deadline:
+			return aoserrors.Wrap(ErrTimeout)
+
+		case <-ctx.Done():
+			return aoserrors.Wrap(ctx.Err())
+		}
+	}
+}
+
+func (module *RenesasUpdateModule) connectQueues() (sendMQ, recvMQ *posix_mq.MessageQueue, err error) {
+	module.queueMutex.Lock()
+	defer module.queueMutex.Unlock()
+
+	if module.sendMQ == nil {
+		if module.sendMQ, module.recvMQ, err = module.openOTAQueues(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return module.sendMQ, module.recvMQ, nil
+}
+
+func (module *RenesasUpdateModule) disconnectQueues() {
+	module.queueMutex.Lock()
+	defer module.queueMutex.Unlock()
+
+	if module.sendMQ == nil {
+		return
+	}
+
+	module.sendMQ.Close()
+	module.recvMQ.Close()
+
+	module.sendMQ, module.recvMQ = nil, nil
+}
+
+// diagnoseQueues logs mounted mqueue filesystems (from /proc/mounts) and which of them contain OTA master queues. If
+// OTA master runs in another container, its queues are visible to the module only if both share IPC namespace and the
+// mqueue filesystem. No mqueue mounts or queues not visible in any of them indicate wrong namespace setup.
+func (module *RenesasUpdateModule) diagnoseQueues() {
+	mounts, err := mqueueMounts()
+	if err != nil {
+		module.logger().Errorf("Can't read mqueue mounts: %v", err)
+
+		return
+	}
+
+	for _, name := range []string{module.config.SendQueueName, module.config.ReceiveQueueName} {
+		visibleIn := []string{}
+
+		for _, mount := range mounts {
+			if _, err := os.Stat(filepath.Join(mount, strings.TrimPrefix(name, "/"))); err == nil {
+				visibleIn = append(visibleIn, mount)
+			}
+		}
+
+		module.logger().WithFields(log.Fields{
+			"queue": name, "mqueueMounts": mounts, "visibleIn": visibleIn,
+		}).Error("OTA master queue diagnostics")
+	}
+}
+
+// openOTAQueues opens OTA master queues. If QueueMaxMsg and QueueMsgSize are configured (both or none, e.g. 10 and
+// 8192, the Linux defaults), they are passed as queue attributes. The kernel applies attributes only when the queue is
+// created, the queues opened by the module keep attributes set by their creator. QueueMsgSize also sets the receive
+// buffer size and must not be less than msgsize of the receive queue, otherwise receiving fails with EMSGSIZE.
+// Without the attributes the receive buffer has the maximum message size.
+//
+// If CreateQueues is set, missing queues are created (O_CREAT) with 0600 mode and the configured attributes, so the
+// module can start before OTA master. Existing queues are opened as is. The module never unlinks the queues: they are
+// shared with OTA master which keeps using them across module restarts, unlinking is up to the master or the system
+// integration.
+func (module *RenesasUpdateModule) openOTAQueues() (sendMQ, recvMQ *posix_mq.MessageQueue, err error) {
+	var (
+		attr  *posix_mq.MessageQueueAttribute
+		oflag int
+	)
+
+	if module.config.CreateQueues {
+		oflag = posix_mq.O_CREAT
+	}
+
+	if module.config.QueueMaxMsg > 0 {
+		attr = &posix_mq.MessageQueueAttribute{
+			MaxMsg: module.config.QueueMaxMsg, MsgSize: module.config.QueueMsgSize,
+		}
+	}
+
+	if sendMQ, err = posix_mq.NewMessageQueue(
+		module.config.SendQueueName, oflag|posix_mq.O_WRONLY, 0o600, attr); err != nil {
+		return nil, nil, newReasonError(ReasonQueueUnavailable, err)
+	}
+
+	if recvMQ, err = posix_mq.NewMessageQueue(
+		module.config.ReceiveQueueName, oflag|posix_mq.O_RDONLY, 0o600, attr); err != nil {
+		sendMQ.Close()
+
+		return nil, nil, newReasonError(ReasonQueueUnavailable, err)
+	}
+
+	return sendMQ, recvMQ, nil
+}
+
+// sendOTARequest sends command and returns response payload. Each frame starts with int64 command (request) or
+// int64 status (response) optionally followed by command specific payload. Frame fields and payloads are encoded in
+// ByteOrder (little endian by default). Send and receive share the same deadline computed from the module clock.
+// Before the terminal response the master may send any number of intermediate otaStatusProgress frames (see
+// handleMasterProgress); they don't extend the deadline.
+func (module *RenesasUpdateModule) sendOTARequest(
+	sendMQ, recvMQ *posix_mq.MessageQueue, command int64, payload []byte,
+) (response []byte, err error) {
+	defer func() {
+		if err != nil {
+			module.updateStats(func(stats *ProtocolStats) {
+				stats.Failures++
+
+				if errors.Is(err, ErrTimeout) || errors.Is(err, ErrBackpressure) {
+					stats.Timeouts++
+				}
+			})
+		}
+	}()
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err = binary.Write(buffer, module.byteOrder, command); err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	buffer.Write(payload)
+
+	start := module.clock.Now()
+	deadline := start.Add(module.commandTimeout(command))
+
+	module.setInFlightCommand(command, deadline)
+	defer module.setInFlightCommand(0, time.Time{})
+
+	if err = module.retryTransient(command, func() error {
+		return sendMQ.TimedSend(buffer.Bytes(), 0, deadline)
+	}); err != nil {
+		if errors.Is(err, syscall.ETIMEDOUT) {
+			return nil, newReasonError(ReasonBackpressure,
+				aoserrors.Errorf("send command %d failed: %w", command, ErrBackpressure))
+		}
+
+		return nil, newReasonError(ReasonQueueUnavailable, err)
+	}
+
+	module.updateStats(func(stats *ProtocolStats) {
+		stats.CommandsSent++
+		stats.BytesTransferred += uint64(buffer.Len())
+	})
+
+	var (
+		recvData []byte
+		status   int64
+	)
+
+	for {
+		if err = module.retryTransient(command, func() (err error) {
+			recvData, err = module.receiveOTAResponse(recvMQ, deadline)
+
+			return err
+		}); err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil, aoserrors.Wrap(err)
+			}
+
+			if errors.Is(err, syscall.ETIMEDOUT) {
+				return nil, newReasonError(ReasonTimeout,
+					aoserrors.Errorf("receive command %d status failed: %w", command, ErrTimeout))
+			}
+
+			return nil, newReasonError(ReasonQueueUnavailable, err)
+		}
+
+		module.updateStats(func(stats *ProtocolStats) { stats.BytesTransferred += uint64(len(recvData)) })
+
+		if module.validator != nil {
+			module.recordPhaseTiming(command, module.setLastCommand().Sub(start))
+
+			return recvData, module.validateResponse(command, recvData)
+		}
+
+		buffer = bytes.NewBuffer(recvData)
+
+		if err = binary.Read(buffer, module.byteOrder, &status); err != nil {
+			return nil, newReasonError(ReasonProtocolError, err)
+		}
+
+		if status != otaStatusProgress {
+			break
+		}
+
+		module.handleMasterProgress(command, buffer.Bytes())
+	}
+
+	module.recordPhaseTiming(command, module.setLastCommand().Sub(start))
+
+	if !isKnownStatus(status) {
+		status = module.handleUnknownStatus(command, status)
+	}
+
+	// Failure response payload, if any, is returned along with error as it may contain failure details.
+	if err = statusToError(command, status); err != nil {
+		return buffer.Bytes(), err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// retryTransient calls handler and, if it fails with transient queue error (EAGAIN or EINTR), retries it up to
+// MaxRetries times with exponential backoff starting from otaRetryDelay. Other errors are returned immediately.
+func (module *RenesasUpdateModule) retryTransient(command int64, handler func() error) (err error) {
+	delay := otaRetryDelay
+
+	for i := 0; ; i++ {
+		if err = handler(); err == nil || i >= module.config.MaxRetries || !isTransientQueueError(err) {
+			return err
+		}
+
+		module.logger().WithFields(log.Fields{
+			"command": command, "attempt": i + 1,
+		}).Warnf("Transient OTA master queue error, retry: %v", err)
+
+		<-module.clock.After(delay)
+
+		delay *= 2
+	}
+}
+
+// handleMasterProgress handles intermediate progress frame. The frame payload is uint32 command progress in percent
+// (0-100). Download progress is reported as ProgressPhaseDownload event scaled to the download part of Prepare
+// progress (40-80%), progress of other commands is logged only.
+func (module *RenesasUpdateModule) handleMasterProgress(command int64, payload []byte) {
+	var percent uint32
+
+	if err := binary.Read(bytes.NewReader(payload), module.byteOrder, &percent); err != nil {
+		module.logger().Warnf("Wrong OTA master progress frame: %v", err)
+
+		return
+	}
+
+	if percent > 100 {
+		percent = 100
+	}
+
+	module.emitEvent(Event{Type: EventCommandProgress, Command: commandName(command), Percent: int(percent)})
+
+	if command != otaCommandDownload {
+		module.logger().WithFields(log.Fields{
+			"command": commandName(command), "percent": percent,
+		}).Debug("OTA master command progress")
+
+		return
+	}
+
+	module.reportProgress(ProgressPhaseDownload, 40+int(percent)*40/100)
+}
+
+// handleUnknownStatus maps status unknown to the module according to UnknownStatusPolicy:
+//
+//   - fail (default): the command fails;
+//   - treat-as-success: the command succeeds. It is risky: a newer master may report a failure with the new status
+//     and the failed update is considered successful;
+//   - treat-as-busy-retry: the command fails with ErrBusy, so the orchestrator retries it. It is risky as well: the
+//     master may have executed the command and retrying it may be not idempotent, or the failure may be permanent
+//     and the orchestrator keeps retrying.
+func (module *RenesasUpdateModule) handleUnknownStatus(command int64, status int64) int64 {
+	logger := module.logger().WithFields(log.Fields{
+		"command": command, "status": status, "policy": module.config.UnknownStatusPolicy,
+	})
+
+	switch module.config.UnknownStatusPolicy {
+	case unknownStatusSuccess:
+		logger.Warn("Unknown OTA master status treated as success")
+
+		return otaStatusSuccess
+
+	case unknownStatusBusy:
+		logger.Warn("Unknown OTA master status treated as busy")
+
+		return otaStatusBusy
+
+	default:
+		logger.Error("Unknown OTA master status")
+
+		return status
+	}
+}
+
+// setInFlightCommand sets command in flight and its deadline. Zero deadline means no command in flight.
+func (module *RenesasUpdateModule) setInFlightCommand(command int64, deadline time.Time) {
+	module.commandMutex.Lock()
+	defer module.commandMutex.Unlock()
+
+	module.commandInFlight, module.commandDeadline = command, deadline
+}
+
+// receiveOTAResponse receives OTA master response until deadline of the module clock. The remaining wait time is
+// computed from the module clock and converted to the system time TimedReceive expects. TimedReceive can't be
+// interrupted, so if the current operation context can be canceled, the wait is split into otaCancelPollInterval
+// intervals and the context is checked between them.
+func (module *RenesasUpdateModule) receiveOTAResponse(
+	recvMQ *posix_mq.MessageQueue, deadline time.Time,
+) (recvData []byte, err error) {
+	ctx := module.operationContext()
+	cancelable := ctx != nil && ctx.Done() != nil
+
+	for {
+		remaining := deadline.Sub(module.clock.Now())
+
+		wait := remaining
+		if cancelable && wait > otaCancelPollInterval {
+			wait = otaCancelPollInterval
+		}
+
+		recvData, _, err = recvMQ.TimedReceive(time.Now().Add(wait))
+		if !errors.Is(err, syscall.ETIMEDOUT) || wait >= remaining {
+			return recvData, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		default:
+		}
+	}
+}
+
+func (module *RenesasUpdateModule) validateResponse(command int64, recvData []byte) error {
+	success, err := module.validator(commandName(command), recvData)
+	if err != nil {
+		if ErrorCode(err) != "" {
+			return err
+		}
+
+		return newReasonError(ReasonProtocolError, err)
+	}
+
+	if !success {
+		return newReasonError(ReasonMasterFailed, aoserrors.Errorf("execute command %d failed", command))
+	}
+
+	return nil
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (noopMetrics) CommandSent(moduleID, command string) {}
+
+func (noopMetrics) CommandSucceeded(moduleID, command string, latency time.Duration) {}
+
+func (noopMetrics) CommandFailed(moduleID, command string, latency time.Duration) {}
+
+func (noopMetrics) StateChanged(moduleID, state string) {}
+
+func (module *RenesasUpdateModule) commandTimeout(command int64) time.Duration {
+	if name := commandName(command); name != "" {
+		return module.GetEffectiveTimeout(name)
+	}
+
+	return module.config.Timeout.Duration
+}
+
+// recordPhaseTiming records duration of update phase commands. Timings are persisted with the next state change.
+func (module *RenesasUpdateModule) recordPhaseTiming(command int64, duration time.Duration) {
+	switch command {
+	case otaCommandSyncCompose, otaCommandDownload, otaCommandInstall, otaCommandActivate:
+		module.addPhaseTiming(commandName(command), duration)
+	}
+}
+
+// setLastCommand records the time of the last OTA master response and returns it.
+func (module *RenesasUpdateModule) setLastCommand() time.Time {
+	now := module.clock.Now()
+
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.lastCommand = now
+
+	return now
+}
+
+func (module *RenesasUpdateModule) setRebootRequired(rebootRequired bool) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.rebootRequired = rebootRequired
+}
+
+func (module *RenesasUpdateModule) resetPhaseTimings() {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	module.PhaseTimings = make(map[string]time.Duration)
+}
+
+func (module *RenesasUpdateModule) addPhaseTiming(phase string, duration time.Duration) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	if module.PhaseTimings == nil {
+		module.PhaseTimings = make(map[string]time.Duration)
+	}
+
+	module.PhaseTimings[phase] += duration
+}
+
+// updateStats applies update to protocol statistics.
+func (module *RenesasUpdateModule) updateStats(update func(stats *ProtocolStats)) {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	update(&module.stats)
+}
+
+func commandName(command int64) string {
+	for name, value := range otaCommandNames {
+		if value == command {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func statusToError(command, status int64) error {
+	switch status {
+	case otaStatusSuccess:
+		return nil
+
+	case otaStatusFailed:
+		return newReasonError(ReasonMasterFailed,
+			aoserrors.Errorf("execute command %d failed: OTA master reported failure", command))
+
+	case otaStatusBusy:
+		return newReasonError(ReasonMasterBusy,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrBusy))
+
+	case otaStatusUnsupported:
+		return newReasonError(ReasonUnsupported,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrUnsupported))
+
+	case otaStatusVerificationFailed:
+		return newReasonError(ReasonChecksumMismatch,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrVerificationFailed))
+
+	case otaStatusDowngradeRejected:
+		return newReasonError(ReasonDowngradeRejected,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrDowngradeRejected))
+
+	case otaStatusNoSpace:
+		return newReasonError(ReasonInsufficientSpace,
+			aoserrors.Errorf("execute command %d failed: not enough space on OTA master", command))
+
+	case otaStatusChunkCorrupted:
+		return newReasonError(ReasonChunkCorrupted,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrChunkCorrupted))
+
+	case otaStatusFlashError:
+		return newReasonError(ReasonFlashError,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrFlashFailed))
+
+	case otaStatusVersionUnsupported:
+		return newReasonError(ReasonVersionUnsupported,
+			aoserrors.Errorf("execute command %d failed: %w", command, ErrVersionUnsupported))
+
+	default:
+		return newReasonError(ReasonMasterFailed,
+			aoserrors.Errorf("execute command %d failed with unknown status %d", command, status))
+	}
+}
+
+func isTransientQueueError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+func isKnownStatus(status int64) bool {
+	return status >= otaStatusSuccess && status <= otaStatusVersionUnsupported
+}
+
+// verifyImage verifies size and checksum of the extracted image against annotations. On mismatch the target file is
+// removed, so the corrupted image is never sent to the master.
+func verifyImage(targetFile string, size int64, annotations json.RawMessage) (err error) {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	var prepareInfo prepareAnnotations
+
+	if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	defer func() {
+		if err != nil {
+			if removeErr := removeTargetFile(targetFile); removeErr != nil {
+				log.WithField("file", targetFile).Errorf("Can't remove target file: %v", removeErr)
+			}
+		}
+	}()
+
+	if prepareInfo.Size != 0 && prepareInfo.Size != size {
+		return newReasonError(ReasonChecksumMismatch, aoserrors.Errorf(
+			"image size mismatch: expected %d, extracted %d: %w", prepareInfo.Size, size, ErrVerificationFailed))
+	}
+
+	if prepareInfo.SHA256 == "" {
+		return nil
+	}
+
+	checksum, err := getFileChecksum(targetFile)
+	if err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+
+	if !strings.EqualFold(checksum, prepareInfo.SHA256) {
+		return newReasonError(ReasonChecksumMismatch, aoserrors.Errorf(
+			"image checksum mismatch: expected %s, got %s: %w", prepareInfo.SHA256, checksum, ErrVerificationFailed))
+	}
+
+	return nil
+}
+
+// verifyTargets verifies checksums of extracted target files. All files are verified. If any file doesn't match, all
+// target files are removed and TargetsError with status of each file is returned. It wraps error of the first failed
+// file.
+func verifyTargets(targets []string, annotations json.RawMessage) (err error) {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	var prepareInfo prepareAnnotations
+
+	if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	defer func() {
+		if err != nil {
+			for _, target := range targets {
+				if removeErr := removeTargetFile(target); removeErr != nil {
+					log.WithField("file", target).Errorf("Can't remove target file: %v", removeErr)
+				}
+			}
+		}
+	}()
+
+	targetsErr := &TargetsError{}
+
+	for _, target := range targets {
+		targetErr := verifyTarget(target, prepareInfo.Checksums)
+
+		if targetErr != nil && targetsErr.err == nil {
+			targetsErr.err = targetErr
+		}
+
+		targetsErr.Targets = append(targetsErr.Targets, TargetStatus{File: target, Err: targetErr})
+	}
+
+	if targetsErr.err != nil {
+		return targetsErr
+	}
+
+	return nil
+}
+
+// removeTargetFile removes target file. Only regular files are removed: target may be a block device (e.g. partition)
+// which must never be unlinked. Absent target is not an error.
+func removeTargetFile(targetFile string) error {
+	info, err := os.Stat(targetFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return aoserrors.Wrap(err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	if err = os.Remove(targetFile); err != nil && !os.IsNotExist(err) {
+		return aoserrors.Wrap(err)
+	}
+
+	log.WithFields(log.Fields{"targetFile": targetFile, "reclaimed": info.Size()}).Info("Target file removed")
+
+	return nil
+}
+
+func verifyTarget(target string, checksums map[string]string) error {
+	expected, ok := checksums[target]
+	if !ok {
+		return nil
+	}
+
+	checksum, err := getFileChecksum(target)
+	if err != nil {
+		return newReasonError(ReasonExtractFailed, err)
+	}
+
+	if !strings.EqualFold(checksum, expected) {
+		return newReasonError(ReasonChecksumMismatch,
+			aoserrors.Errorf("target file %s checksum mismatch: %w", target, ErrVerificationFailed))
+	}
+
+	return nil
+}
+
+func getFileChecksum(fileName string) (checksum string, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// extractError classifies image extraction error: corrupted archive, out of space on the target file system
+// (free bytes are reported) or other IO error.
+func extractError(targetFile string, err error) error {
+	var (
+		corruptErr flate.CorruptInputError
+		pathErr    *os.PathError
+		errno      syscall.Errno
+	)
+
+	switch {
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &corruptErr), isZstdCorrupted(err):
+		return newReasonError(ReasonArchiveCorrupted, aoserrors.Errorf("image archive corrupted: %w", err))
+
+	case errors.Is(err, syscall.ENOSPC):
+		var stat syscall.Statfs_t
+
+		if statErr := syscall.Statfs(filepath.Dir(targetFile), &stat); statErr != nil {
+			return newReasonError(ReasonInsufficientSpace, err)
+		}
+
+		return newReasonError(ReasonInsufficientSpace, aoserrors.Errorf(
+			"no space left to extract image, free %d bytes: %w", stat.Bavail*uint64(stat.Bsize), err))
+
+	case errors.As(err, &pathErr), errors.As(err, &errno):
+		return newReasonError(ReasonIOError, aoserrors.Errorf("image extraction IO error: %w", err))
+
+	default:
+		return newReasonError(ReasonExtractFailed, err)
+	}
+}
+
+func isZstdCorrupted(err error) bool {
+	for _, corruptErr := range []error{
+		zstd.ErrMagicMismatch, zstd.ErrCRCMismatch, zstd.ErrReservedBlockType, zstd.ErrCompressedSizeTooBig,
+		zstd.ErrBlockTooSmall, zstd.ErrWindowSizeTooSmall,
+	} {
+		if errors.Is(err, corruptErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSequences converts configured command sequences to OTA master commands. A configured sequence replaces
+// built-in command handling of the corresponding phase ("prepare", "update" or "revert") including phase options such
+// as ValidateBeforeDownload and FlushAfterInstall. Prepare sequence can't be combined with chunked upload, multiple
+// targets or target override.
+func parseSequences(sequences map[string][]string) (commandSequences map[string][]int64, err error) {
+	commandSequences = make(map[string][]int64)
+
+	for name, commandNames := range sequences {
+		if name != sequencePrepare && name != sequenceUpdate && name != sequenceRevert {
+			return nil, aoserrors.Errorf("unknown sequence: %s", name)
+		}
+
+		if len(commandNames) == 0 {
+			return nil, aoserrors.Errorf("sequence %s is empty", name)
+		}
+
+		commands := make([]int64, 0, len(commandNames))
+
+		for _, commandName := range commandNames {
+			command, ok := otaCommandNames[commandName]
+			if !ok {
+				return nil, aoserrors.Errorf("unknown command in sequence %s: %s", name, commandName)
+			}
+
+			commands = append(commands, command)
+		}
+
+		commandSequences[name] = commands
+	}
+
+	return commandSequences, nil
+}
+
+// lockTarget takes exclusive advisory lock (flock) on target file. The master is expected to hold shared lock on the
+// target file while reading it, so the file is not truncated while it is in use. Missing target file can't be in use,
+// so nothing is locked and the file is not created.
+func lockTarget(targetFile string) (unlock func(), err error) {
+	file, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return func() {}, nil
+		}
+
+		return nil, newReasonError(ReasonExtractFailed, err)
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, newReasonError(ReasonTargetInUse,
+				aoserrors.Errorf("target file %s: %w", targetFile, ErrTargetInUse))
+		}
+
+		return nil, newReasonError(ReasonExtractFailed, err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// acquireExtraction waits for extraction slot and returns function to release it.
+func acquireExtraction() (release func()) {
+	extractionMutex.Lock()
+	semaphore := extractionSemaphore
+	extractionMutex.Unlock()
+
+	if semaphore == nil {
+		return func() {}
+	}
+
+	semaphore <- struct{}{}
+
+	return func() { <-semaphore }
+}
+
+func isPermanentStorageError(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrInvalid)
+}
+
+func commandsMask(commands ...int64) (mask uint64) {
+	for _, command := range commands {
+		mask |= 1 << uint64(command)
+	}
+
+	return mask
+}
+
+// mqueueMounts returns mount points of mqueue filesystems.
+func mqueueMounts() (mounts []string, err error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 2 && fields[2] == "mqueue" {
+			mounts = append(mounts, fields[1])
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	return mounts, nil
+}
+
+// checkTargetFiles checks configured target files. Images of multiple targets are mapped by target file base name
+// (see extractTargets), so base names should be unique. Chunked upload and custom prepare sequence don't support
+// multiple targets.
+func (module *RenesasUpdateModule) checkTargetFiles() error {
+	if module.config.TargetFile == "" {
+		return aoserrors.New("target file name should be configured")
+	}
+
+	if !module.isMultiTarget() {
+		return nil
+	}
+
+	names := make(map[string]bool)
+
+	for _, targetFile := range module.config.TargetFiles {
+		if targetFile == "" {
+			return aoserrors.New("target file name should not be empty")
+		}
+
+		if names[filepath.Base(targetFile)] {
+			return aoserrors.Errorf("duplicated target file base name: %s", filepath.Base(targetFile))
+		}
+
+		names[filepath.Base(targetFile)] = true
+	}
+
+	if module.config.UploadChunkSize > 0 {
+		return aoserrors.New("chunked upload doesn't support multiple target files")
+	}
+
+	if _, ok := module.config.Sequences[sequencePrepare]; ok {
+		return aoserrors.New("prepare sequence doesn't support multiple target files")
+	}
+
+	return nil
+}
+
+func (module *RenesasUpdateModule) isMultiTarget() bool {
+	return len(module.config.TargetFiles) > 1
+}
+
+// targetFiles returns target files of the current prepare: target overridden by annotations or configured targets.
+func (module *RenesasUpdateModule) targetFiles() []string {
+	module.stateMutex.Lock()
+	defer module.stateMutex.Unlock()
+
+	if module.TargetOverride != "" {
+		return []string{module.TargetOverride}
+	}
+
+	return module.config.TargetFiles
+}
+
+func (module *RenesasUpdateModule) primaryTarget() string {
+	return module.targetFiles()[0]
+}
+
+// resolveTargetOverride returns target file selected by prepare annotations or empty string if the configured target
+// should be used. Slot selects one of SlotTargetFiles configured for the module. TargetFile is an arbitrary path, so
+// it is accepted only if TargetBaseDir is configured and the path, with symlinks resolved, stays within it. Relative
+// paths are relative to TargetBaseDir. The override is not supported with multiple configured targets or configured
+// prepare sequence.
+func (module *RenesasUpdateModule) resolveTargetOverride(annotations json.RawMessage) (targetFile string, err error) {
+	var prepareInfo prepareAnnotations
+
+	if len(annotations) != 0 {
+		if err = json.Unmarshal(annotations, &prepareInfo); err != nil {
+			return "", aoserrors.Wrap(err)
+		}
+	}
+
+	if prepareInfo.TargetFile == "" && prepareInfo.Slot == "" {
+		return "", nil
+	}
+
+	if module.isMultiTarget() {
+		return "", aoserrors.New("target override is not supported with multiple target files")
+	}
+
+	if _, ok := module.sequences[sequencePrepare]; ok {
+		return "", aoserrors.New("target override is not supported with prepare sequence")
+	}
+
+	if prepareInfo.TargetFile != "" && prepareInfo.Slot != "" {
+		return "", aoserrors.New("either target file or slot should be annotated")
+	}
+
+	if prepareInfo.Slot != "" {
+		if targetFile = module.config.SlotTargetFiles[prepareInfo.Slot]; targetFile == "" {
+			return "", aoserrors.Errorf("unknown slot: %s", prepareInfo.Slot)
+		}
+
+		return targetFile, nil
+	}
+
+	if module.config.TargetBaseDir == "" {
+		return "", aoserrors.New("target file override is not allowed: target base dir is not configured")
+	}
+
+	targetFile = prepareInfo.TargetFile
+
+	if !filepath.IsAbs(targetFile) {
+		targetFile = filepath.Join(module.config.TargetBaseDir, targetFile)
+	}
+
+	if !isWithinDir(module.config.TargetBaseDir, filepath.Clean(targetFile)) {
+		return "", aoserrors.Errorf("target file %s is outside of target base dir", prepareInfo.TargetFile)
+	}
+
+	return filepath.Clean(targetFile), nil
+}
+
+// isWithinDir returns true if path is located inside dir. Symlinks of existing path components are resolved, so the
+// path can't escape dir through a symlink.
+func isWithinDir(dir, path string) bool {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		resolvedDir = filepath.Clean(dir)
+	}
+
+	resolvedPath, err := evalExistingSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(resolvedDir, resolvedPath)
+	if err != nil {
+		return false
+	}
+
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalExistingSymlinks resolves symlinks of the longest existing prefix of path and appends the rest of path to it.
+func evalExistingSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", aoserrors.Wrap(err)
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+
+	if resolved, err = evalExistingSymlinks(parent); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// checkWorkDir creates module work directory if it doesn't exist and checks that it is writable. The work directory
+// contains module temporary files: temporary target file and fetched remote images.
+func checkWorkDir(workDir string) error {
+	if err := os.MkdirAll(workDir, 0o700); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	file, err := ioutil.TempFile(workDir, "check")
+	if err != nil {
+		return aoserrors.Errorf("work directory %s is not writable: %v", workDir, err)
+	}
+
+	file.Close()
+
+	if err = os.Remove(file.Name()); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	return nil
+}
+
+// detectCompression returns image compression format detected by magic bytes or empty string if the format is
+// unknown.
+func detectCompression(imagePath string) (compression string, err error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+
+	size, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", aoserrors.Wrap(err)
+	}
+
+	for format, magic := range compressionMagics {
+		if bytes.HasPrefix(header[:size], magic) {
+			return format, nil
+		}
+	}
+
+	return "", nil
+}
+
+func isRemoteImage(imagePath string) bool {
+	imageURL, err := url.Parse(imagePath)
+
+	return err == nil && (imageURL.Scheme == "http" || imageURL.Scheme == "https")
+}
+
+// downloadImage downloads image by URL into the directory and returns path of the downloaded file. The file is named
+// as the last element of the URL path. The request is canceled when ctx is done.
+func downloadImage(ctx context.Context, dir, imageURL string) (fileName string, err error) {
+	log.WithField("url", imageURL).Debug("Download remote image")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", aoserrors.Errorf("can't download %s: %s", imageURL, resp.Status)
+	}
+
+	name := path.Base(req.URL.Path)
+	if name == "/" || name == "." {
+		name = "image"
+	}
+
+	fileName = filepath.Join(dir, name)
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, resp.Body); err != nil {
+		return "", aoserrors.Wrap(err)
+	}
+
+	return fileName, nil
+}
+
+// imageSize returns uncompressed size of the image of the given compression.
+func imageSize(imagePath, compression string) (size uint64, err error) {
+	switch compression {
+	case compressionZstd:
+		return getZstdImageSize(imagePath)
+
+	case compressionNone:
+		info, err := os.Stat(imagePath)
+		if err != nil {
+			return 0, aoserrors.Wrap(err)
+		}
+
+		return uint64(info.Size()), nil
+
+	default:
+		return getGzipImageSize(imagePath)
+	}
+}
+
+// getGzipImageSize returns uncompressed image size stored in gzip trailer (ISIZE field).
+func getGzipImageSize(imagePath string) (size uint64, err error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	if _, err = file.Seek(-4, io.SeekEnd); err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	var isize uint32
+
+	if err = binary.Read(file, binary.LittleEndian, &isize); err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	return uint64(isize), nil
+}
+
+// getZstdImageSize returns uncompressed image size stored in zstd frame header (frame content size). If the header
+// doesn't contain content size, the image is decompressed to count its size.
+func getZstdImageSize(imagePath string) (size uint64, err error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer file.Close()
+
+	data := make([]byte, zstd.HeaderMaxSize)
+
+	read, err := io.ReadFull(file, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	var header zstd.Header
+
+	if err = header.Decode(data[:read]); err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	if header.HasFCS {
+		return header.FrameContentSize, nil
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer decoder.Close()
+
+	written, err := io.Copy(ioutil.Discard, decoder)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+
+	return uint64(written), nil
+}
+
+// copyFromArchive decompresses image archive of the given compression into existing dst file and returns number of
+// decompressed bytes. Raw image (compression "none") is copied as is.
+func copyFromArchive(dst, src, compression string) (copied int64, err error) {
+	switch compression {
+	case compressionGzip:
+		return partition.CopyFromGzipArchive(dst, src)
+
+	case compressionZstd:
+		return copyFromZstdArchive(dst, src)
+
+	case compressionNone:
+		return copyRawImage(dst, src)
+
+	default:
+		return 0, aoserrors.Errorf("unsupported image compression: %s", compression)
+	}
+}
+
+// replaceFile atomically replaces dst file with src file. If the files are on different file systems, src is copied
+// into temporary file next to dst, which is synced and renamed to dst, so dst is never left partially written.
+func replaceFile(dst, src string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return aoserrors.Wrap(err)
+	}
+
+	tmpFile := dst + ".tmp"
+
+	if err = copyFileSync(tmpFile, src); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFile, dst); err != nil {
+		if removeErr := os.Remove(tmpFile); removeErr != nil {
+			log.WithField("file", tmpFile).Errorf("Can't remove temporary file: %v", removeErr)
+		}
+
+		return aoserrors.Wrap(err)
+	}
+
+	return aoserrors.Wrap(os.Remove(src))
+}
+
+// copyFileSync copies src file into created or truncated dst file and syncs it to the storage. The dst file is removed
+// on error.
+func copyFileSync(dst, src string) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return aoserrors.Wrap(err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return aoserrors.Wrap(err)
+	}
+	defer dstFile.Close()
+
+	defer func() {
+		if err != nil {
+			if removeErr := os.Remove(dst); removeErr != nil {
+				log.WithField("file", dst).Errorf("Can't remove file: %v", removeErr)
+			}
+		}
+	}()
+
+	if _, err = io.Copy(dstFile, bufio.NewReader(srcFile)); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	if err = dstFile.Sync(); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	return aoserrors.Wrap(dstFile.Close())
+}
+
+// copyRawImage copies raw image into existing dst file. The dst file is not truncated as it may be a block device.
+func copyRawImage(dst, src string) (copied int64, err error) {
+	log.WithFields(log.Fields{"src": src, "dst": dst}).Debug("Copy partition from raw image")
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_RDWR, 0)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer dstFile.Close()
+
+	if copied, err = io.Copy(dstFile, bufio.NewReader(srcFile)); err != nil {
+		return copied, aoserrors.Wrap(err)
+	}
+
+	return copied, nil
+}
+
+// copyFromZstdArchive is zstd counterpart of partition.CopyFromGzipArchive. The dst file is not truncated as it may be
+// a block device.
+func copyFromZstdArchive(dst, src string) (copied int64, err error) {
+	log.WithFields(log.Fields{"src": src, "dst": dst}).Debug("Copy partition from zstd archive")
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_RDWR, 0)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer dstFile.Close()
+
+	decoder, err := zstd.NewReader(srcFile)
+	if err != nil {
+		return 0, aoserrors.Wrap(err)
+	}
+	defer decoder.Close()
+
+	if copied, err = io.Copy(dstFile, decoder); err != nil {
+		return copied, aoserrors.Wrap(err)
+	}
+
+	return copied, nil
 }
@@ -2,19 +2,31 @@ package renesasota_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/aoscloud/aos_common/aoserrors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/syucream/posix_mq"
 
@@ -29,7 +41,8 @@ const (
 	commandQueue = "/ota_master_queue"
 	statusQueue  = "/ota_mater_result"
 
-	queueTimeout = 1 * time.Second
+	queueTimeout       = 1 * time.Second
+	masterPollInterval = 10 * time.Millisecond
 )
 
 /***********************************************************************************************************************
@@ -41,12 +54,41 @@ type testOtaMaster struct {
 
 	sendMQ       *posix_mq.MessageQueue
 	recvMQ       *posix_mq.MessageQueue
+	stopChannel  chan struct{}
+	wg           sync.WaitGroup
 	recvCommands []int64
 	statusMap    map[int64]int64
+	payloadMap   map[int64][]byte
+	handler      requestHandler
+	byteOrder    binary.ByteOrder
 }
 
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+type requestHandler func(command int64, payload []byte) (status int64, reply bool)
+
 type testStateStorage struct {
-	state []byte
+	sync.Mutex
+	state      []byte
+	getErrors  []error
+	writeCount int
+}
+
+// testLogHook calls onMessage for each log entry containing message.
+type testLogHook struct {
+	message   string
+	onMessage func()
+}
+
+// testMetrics counts commands by command name and records module states.
+type testMetrics struct {
+	sent      map[string]int
+	succeeded map[string]int
+	failed    map[string]int
+	states    []string
 }
 
 /***********************************************************************************************************************
@@ -96,7 +138,7 @@ func TestMain(m *testing.M) {
 
 func TestUpdate(t *testing.T) {
 	master, err := newTestOtaMaster(statusQueue, commandQueue,
-		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0})
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
 	if err != nil {
 		t.Fatalf("Can't create test OTA master: %v", err)
 	}
@@ -187,9 +229,58 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestStrictApply(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		t.Logf("Strict: %v", strict)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"strictApply": strict}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); err != nil {
+			t.Fatalf("Error update module: %v", err)
+		}
+
+		if _, err = module.Apply(); err != nil {
+			t.Errorf("Error apply module: %v", err)
+		}
+
+		_, err = module.Apply()
+
+		if !strict && err != nil {
+			t.Errorf("Error apply module: %v", err)
+		}
+
+		if strict && !errors.Is(err, renesasota.ErrNothingToApply) {
+			t.Errorf("Wrong apply error: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
 func TestRevert(t *testing.T) {
 	master, err := newTestOtaMaster(statusQueue, commandQueue,
-		map[int64]int64{0: 0, 1: 0, 2: 1, 3: 0, 4: 0})
+		map[int64]int64{0: 0, 1: 0, 2: 1, 3: 0, 4: 0}, nil)
 	if err != nil {
 		t.Fatalf("Can't create test OTA master: %v", err)
 	}
@@ -268,115 +359,7187 @@ func TestRevert(t *testing.T) {
 	}
 }
 
-/***********************************************************************************************************************
- * testOtaMaster
- **********************************************************************************************************************/
-
-func newTestOtaMaster(sendQueue, receiveQueue string, statusMap map[int64]int64) (master *testOtaMaster, err error) {
-	localMaster := &testOtaMaster{
-		statusMap: statusMap,
+func TestCleanupOnRevert(t *testing.T) {
+	type testData struct {
+		status  int64
+		device  bool
+		success bool
 	}
 
-	defer func() {
-		if err != nil {
-			localMaster.close()
-		}
-	}()
-
-	if localMaster.sendMQ, err = posix_mq.NewMessageQueue(
-		sendQueue, posix_mq.O_CREAT|posix_mq.O_WRONLY, 0o600, nil); err != nil {
-		return nil, aoserrors.Wrap(err)
+	data := []testData{
+		{status: 0, success: true},
+		{status: 3, success: true},
+		{status: 1, success: false},
+		{status: 0, device: true, success: true},
 	}
 
-	if localMaster.recvMQ, err = posix_mq.NewMessageQueue(
-		receiveQueue, posix_mq.O_CREAT|posix_mq.O_RDONLY, 0o600, nil); err != nil {
-		return nil, aoserrors.Wrap(err)
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
 	}
 
-	go func() {
-		for {
-			data, _, err := localMaster.recvMQ.Receive()
-			if err != nil {
-				log.Errorf("Receive message error: %v", err)
+	for i, item := range data {
+		t.Logf("Status: %d", i)
 
-				return
-			}
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 4: 0, 15: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
 
-			buffer := bytes.NewBuffer(data)
+		targetFile := filepath.Join(tmpDir, "target.dat")
 
-			var command int64
+		if item.device {
+			targetFile = createNullDevice(t, filepath.Join(tmpDir, "device"))
+			defer os.Remove(targetFile)
+		}
 
-			if err = binary.Read(buffer, binary.LittleEndian, &command); err != nil {
-				log.Errorf("Read message error: %v", err)
-			}
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+			map[string]interface{}{"cleanupOnRevert": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
 
-			localMaster.Lock()
-			localMaster.recvCommands = append(localMaster.recvCommands, command)
-			localMaster.Unlock()
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
 
-			status, ok := localMaster.statusMap[command]
-			if !ok {
-				continue
-			}
+		master.getRecvCommands()
 
-			buffer = bytes.NewBuffer(nil)
+		_, err = module.Revert()
 
-			if err = binary.Write(buffer, binary.LittleEndian, status); err != nil {
-				log.Errorf("Write message error: %v", err)
+		if item.success {
+			if err != nil {
+				t.Errorf("Error revert module: %v", err)
 			}
 
-			if err = localMaster.sendMQ.Send(buffer.Bytes(), 0); err != nil {
-				log.Errorf("Send message error: %v", err)
+			if _, err = os.Stat(targetFile); os.IsNotExist(err) != !item.device {
+				t.Errorf("Wrong target file state: %v", err)
 			}
 		}
-	}()
 
-	return localMaster, nil
+		if !item.success && err == nil {
+			t.Error("Revert should fail")
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{4, 15}) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
 }
 
-func (master *testOtaMaster) getRecvCommands() []int64 {
-	master.Lock()
-	defer master.Unlock()
+func TestSequences(t *testing.T) {
+	for _, sequences := range []map[string][]string{
+		{"unknown": {"install"}},
+		{"update": {"unknown"}},
+		{"update": {}},
+	} {
+		if _, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"sequences": sequences}), &testStateStorage{}); err == nil {
+			t.Errorf("Module creation should fail: %v", sequences)
+		}
+	}
 
-	recvCommands := master.recvCommands
+	// Prepare sequence can't be combined with chunked upload
 
-	master.recvCommands = nil
+	if _, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{
+			"sequences": map[string][]string{"prepare": {"download"}}, "uploadChunkSize": 4,
+		}), &testStateStorage{}); err == nil {
+		t.Error("Module creation should fail")
+	}
 
-	return recvCommands
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0, 12: 0, 19: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{
+			"sequences": map[string][]string{
+				"prepare": {"syncCompose", "validate", "download"},
+				"update":  {"install", "flush", "activate"},
+			},
+			"slotTargetFiles": map[string]string{"b": filepath.Join(tmpDir, "slot_b.dat")},
+		}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 19, 1}) {
+		t.Error("Wrong commands received")
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{2, 12, 3}) {
+		t.Error("Wrong commands received")
+	}
+
+	if _, err = module.Revert(); err != nil {
+		t.Fatalf("Error revert module: %v", err)
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{4}) {
+		t.Error("Wrong commands received")
+	}
+
+	// Prepare sequence can't be combined with target override
+
+	if err = module.Prepare(imageFile, "2.1.0", json.RawMessage(`{"slot":"b"}`)); err == nil {
+		t.Error("Prepare with target override should fail")
+	}
+
+	if commands := master.getRecvCommands(); len(commands) != 0 {
+		t.Errorf("Wrong commands received: %v", commands)
+	}
 }
 
-func (master *testOtaMaster) close() {
-	if master.recvMQ != nil {
-		_ = master.recvMQ.Unlink()
+func TestProbeBeforeUpdate(t *testing.T) {
+	const imageContent = "this is image content"
+
+	type testData struct {
+		capabilities uint64
+		freeSpace    uint64
+		success      bool
 	}
 
-	if master.sendMQ != nil {
-		_ = master.sendMQ.Unlink()
+	data := []testData{
+		{capabilities: 0x1f, freeSpace: uint64(len(imageContent)), success: true},
+		{capabilities: 0x0f, freeSpace: uint64(len(imageContent)), success: false},
+		{capabilities: 0xff, freeSpace: uint64(len(imageContent)) - 1, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Probe: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0, 5: 0, 6: 0, 7: 0},
+			map[int64][]byte{5: []byte("1.0.0"), 6: uint64Payload(item.capabilities), 7: uint64Payload(item.freeSpace)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"probeBeforeUpdate": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success && err == nil {
+			t.Error("Prepare should fail")
+		}
+
+		expectedCommands := []int64{5, 6, 7}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 0, 1)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
 	}
 }
 
-/***********************************************************************************************************************
- * testStateStorage
- **********************************************************************************************************************/
+func TestMaxMasterQueueDepth(t *testing.T) {
+	type testData struct {
+		status  int64
+		depth   uint32
+		success bool
+	}
 
-func (storage *testStateStorage) GetModuleState(id string) (state []byte, err error) {
-	return storage.state, nil
+	data := []testData{
+		{status: 0, depth: 2, success: true},
+		{status: 3, success: true},
+		{status: 0, depth: 3, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Depth: %d", i)
+
+		payload := bytes.NewBuffer(nil)
+
+		if err := binary.Write(payload, binary.LittleEndian, item.depth); err != nil {
+			t.Fatalf("Can't write payload: %v", err)
+		}
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 17: item.status}, map[int64][]byte{17: payload.Bytes()})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"maxMasterQueueDepth": 2}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success && (!errors.Is(err, renesasota.ErrMasterBacklogged) || !renesasota.IsRetryable(err)) {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		expectedCommands := []int64{17}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 0, 1)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
 }
 
-func (storage *testStateStorage) SetModuleState(id string, state []byte) (err error) {
-	storage.state = state
+func TestAllowedVersions(t *testing.T) {
+	type testData struct {
+		allowedVersions []string
+		version         string
+		success         bool
+	}
 
-	return nil
+	data := []testData{
+		{allowedVersions: nil, version: "2.1.0", success: true},
+		{allowedVersions: []string{"2.0.0", "2.1.0"}, version: "2.1.0", success: true},
+		{allowedVersions: []string{"2.0.0", "2.1.0"}, version: "3.0.0", success: false},
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Version: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"allowedVersions": item.allowedVersions}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, item.version, nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success && renesasota.ErrorCode(err) != renesasota.ReasonVersionNotAllowed {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		module.Close()
+	}
 }
 
-/***********************************************************************************************************************
- * Private
- **********************************************************************************************************************/
+func TestRetryableErrors(t *testing.T) {
+	type testData struct {
+		statusMap map[int64]int64
+		retryable bool
+		code      string
+	}
 
-func moduleConfig(targetFile string) json.RawMessage {
-	return json.RawMessage(
-		fmt.Sprintf(`{"sendQueueName":"%s","receiveQueueName":"%s","timeout":"%s","targetFile":"%s"}`,
-			commandQueue, statusQueue, queueTimeout.String(), targetFile))
+	data := []testData{
+		{statusMap: map[int64]int64{0: 0, 1: 0, 2: 1}, retryable: false, code: renesasota.ReasonMasterFailed},
+		{statusMap: map[int64]int64{0: 0, 1: 0, 2: 2}, retryable: true, code: renesasota.ReasonMasterBusy},
+		{statusMap: map[int64]int64{0: 0, 1: 0, 2: 3}, retryable: false, code: renesasota.ReasonUnsupported},
+		{statusMap: map[int64]int64{0: 0, 1: 0, 2: 4}, retryable: false, code: renesasota.ReasonChecksumMismatch},
+		{statusMap: map[int64]int64{0: 0, 1: 0, 2: 5}, retryable: false, code: renesasota.ReasonDowngradeRejected},
+		{statusMap: map[int64]int64{0: 0, 1: 0}, retryable: true, code: renesasota.ReasonTimeout},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, item.statusMap, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New(
+			"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); err == nil {
+			t.Error("Update should fail")
+		}
+
+		if renesasota.IsRetryable(err) != item.retryable {
+			t.Errorf("Wrong retryable classification: %v", err)
+		}
+
+		if code := renesasota.ErrorCode(err); code != item.code {
+			t.Errorf("Wrong error code: %s", code)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestUpdateCount(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	storage := &testStateStorage{}
+	config := moduleConfig(filepath.Join(tmpDir, "target.dat"))
+
+	module, err := renesasota.New("test", config, storage)
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = module.Update(); err != nil {
+			t.Fatalf("Error update module: %v", err)
+		}
+	}
+
+	if count := module.(*renesasota.RenesasUpdateModule).GetUpdateCount(); count != 1 {
+		t.Errorf("Wrong update count: %d", count)
+	}
+
+	module.Close()
+
+	if module, err = renesasota.New("test", config, storage); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if count := module.(*renesasota.RenesasUpdateModule).GetUpdateCount(); count != 1 {
+		t.Errorf("Wrong update count: %d", count)
+	}
+
+	if imagePath := module.(*renesasota.RenesasUpdateModule).GetLastImagePath(); imagePath != imageFile {
+		t.Errorf("Wrong last image path: %s", imagePath)
+	}
+
+	timings := module.(*renesasota.RenesasUpdateModule).GetLastPhaseTimings()
+
+	for _, phase := range []string{"extract", "syncCompose", "download", "install", "activate"} {
+		if _, ok := timings[phase]; !ok {
+			t.Errorf("Phase timing is missing: %s", phase)
+		}
+	}
+}
+
+func TestStateIntegrity(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	const updateVersion = "2.1.0"
+
+	storage := &testStateStorage{}
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	config := moduleConfigWithOptions(targetFile, map[string]interface{}{"stateHmacKey": "secret"})
+
+	module, err := renesasota.New("test", config, storage)
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, updateVersion, nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	module.Close()
+
+	// Valid state
+
+	if module, err = renesasota.New("test", config, storage); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	if version, _ := module.GetVendorVersion(); version != updateVersion {
+		t.Errorf("Wrong vendor version: %s", version)
+	}
+
+	if !module.(*renesasota.RenesasUpdateModule).Ready() {
+		t.Error("Module should be ready with valid state")
+	}
+
+	module.Close()
+
+	// Tampered state
+
+	storage.state = bytes.Replace(storage.state, []byte(updateVersion), []byte("9.9.9"), 1)
+
+	if module, err = renesasota.New("test", config, storage); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	if version, _ := module.GetVendorVersion(); version != "" {
+		t.Errorf("Wrong vendor version: %s", version)
+	}
+
+	if module.(*renesasota.RenesasUpdateModule).Ready() {
+		t.Error("Module should not be ready with tampered state")
+	}
+
+	module.Close()
+
+	// Strict integrity
+
+	if _, err = renesasota.New("test", moduleConfigWithOptions(targetFile, map[string]interface{}{
+		"stateHmacKey": "secret", "strictStateIntegrity": true,
+	}), storage); err == nil {
+		t.Error("Module creation should fail")
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	const (
+		imageContent  = "this is image content"
+		chunkSize     = 4
+		corruptChunk  = 2
+		timeoutChunk  = 3
+		commandChunk  = 9
+		statusCorrupt = 6
+	)
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	var (
+		received  []byte
+		corrupted bool
+	)
+
+	handler := func(failChunk uint32) requestHandler {
+		return func(command int64, payload []byte) (status int64, reply bool) {
+			if command != commandChunk {
+				return 0, true
+			}
+
+			var header struct{ Index, Length, CRC uint32 }
+
+			reader := bytes.NewReader(payload)
+
+			if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+				t.Errorf("Can't read chunk header: %v", err)
+			}
+
+			data := payload[len(payload)-reader.Len():]
+
+			if int(header.Length) != len(data) || header.CRC != crc32.ChecksumIEEE(data) {
+				t.Errorf("Wrong chunk %d", header.Index)
+			}
+
+			if header.Index == failChunk {
+				return 0, false
+			}
+
+			if header.Index == corruptChunk && !corrupted {
+				corrupted = true
+
+				return statusCorrupt, true
+			}
+
+			received = append(received, data...)
+
+			return 0, true
+		}
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	storage := &testStateStorage{}
+	config := moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"uploadChunkSize": chunkSize})
+
+	// Interrupted upload
+
+	master.setHandler(handler(timeoutChunk))
+
+	module, err := renesasota.New("test", config, storage)
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); !errors.Is(err, renesasota.ErrTimeout) {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 9, 9, 9, 9, 9}) {
+		t.Error("Wrong commands received")
+	}
+
+	module.Close()
+
+	// Resumed upload
+
+	master.setHandler(handler(math.MaxUint32))
+
+	if module, err = renesasota.New("test", config, storage); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{9, 9, 9, 1}) {
+		t.Error("Wrong commands received")
+	}
+
+	if string(received) != imageContent {
+		t.Errorf("Wrong uploaded content: %s", string(received))
+	}
+}
+
+func TestClockDeadline(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"timeout": "1h"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	clock := &testClock{now: time.Now()}
+
+	module.(*renesasota.RenesasUpdateModule).SetClock(clock)
+
+	// Response deadline expires when the module clock passes it
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		clock.set(clock.Now().Add(2 * time.Hour))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	err = module.(*renesasota.RenesasUpdateModule).PrepareWithContext(ctx, imageFile, "2.1.0", nil)
+	if !errors.Is(err, renesasota.ErrTimeout) {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	if time.Since(start) >= 5*time.Second {
+		t.Error("Deadline is not computed from module clock")
+	}
+}
+
+func TestPreparedAge(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	storage := &testStateStorage{}
+	config := moduleConfig(filepath.Join(tmpDir, "target.dat"))
+	clock := &testClock{now: time.Now()}
+
+	module, err := renesasota.New("test", config, storage)
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	module.(*renesasota.RenesasUpdateModule).SetClock(clock)
+
+	if _, prepared := module.(*renesasota.RenesasUpdateModule).GetPreparedAge(); prepared {
+		t.Error("Module should not be prepared")
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	module.Close()
+
+	// Prepared age is restored from storage
+
+	if module, err = renesasota.New("test", config, storage); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	clock.now = clock.now.Add(time.Hour)
+
+	module.(*renesasota.RenesasUpdateModule).SetClock(clock)
+
+	age, prepared := module.(*renesasota.RenesasUpdateModule).GetPreparedAge()
+	if !prepared {
+		t.Error("Module should be prepared")
+	}
+
+	if age != time.Hour {
+		t.Errorf("Wrong prepared age: %v", age)
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	if _, prepared = module.(*renesasota.RenesasUpdateModule).GetPreparedAge(); prepared {
+		t.Error("Module should not be prepared")
+	}
+}
+
+func TestBootAttemptLimit(t *testing.T) {
+	type testData struct {
+		status  int64
+		success bool
+	}
+
+	data := []testData{
+		{status: 0, success: true},
+		{status: 3, success: true},
+		{status: 1, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 10: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"bootAttemptLimit": 3}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		_, err = module.Update()
+
+		if item.success && err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if !item.success && err == nil {
+			t.Error("Update should fail")
+		}
+
+		expectedCommands := []int64{10}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 2, 3)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestPreallocateOnMaster(t *testing.T) {
+	const imageContent = "Some image content"
+
+	type testData struct {
+		status int64
+		code   string
+	}
+
+	data := []testData{
+		{status: 0, code: ""},
+		{status: 3, code: ""},
+		{status: 7, code: renesasota.ReasonInsufficientSpace},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		var size uint64
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command != 23 {
+				return 0, true
+			}
+
+			if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, &size); err != nil {
+				t.Errorf("Can't read preallocate size: %v", err)
+			}
+
+			return item.status, true
+		})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"preallocateOnMaster": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); renesasota.ErrorCode(err) != item.code {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if size != uint64(len(imageContent)) {
+			t.Errorf("Wrong preallocate size: %d", size)
+		}
+
+		expectedCommands := []int64{23}
+
+		if item.code == "" {
+			expectedCommands = append(expectedCommands, 0, 1)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestVerifyPreparedOnMaster(t *testing.T) {
+	type testData struct {
+		status  int64
+		state   uint32
+		success bool
+	}
+
+	data := []testData{
+		{status: 0, state: 1, success: true},
+		{status: 3, success: true},
+		{status: 0, state: 0, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("State: %d", i)
+
+		payload := bytes.NewBuffer(nil)
+
+		if err := binary.Write(payload, binary.LittleEndian, item.state); err != nil {
+			t.Fatalf("Can't write payload: %v", err)
+		}
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 20: item.status}, map[int64][]byte{20: payload.Bytes()})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"verifyPreparedOnMaster": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success && renesasota.ErrorCode(err) != renesasota.ReasonMasterNotReady {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 1, 20}) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMasterVerifiesSignature(t *testing.T) {
+	const failReason = "untrusted certificate"
+
+	type testData struct {
+		status  int64
+		success bool
+	}
+
+	data := []testData{
+		{status: 0, success: true},
+		{status: 3, success: true},
+		{status: 4, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 13: item.status}, map[int64][]byte{13: []byte(failReason)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"masterVerifiesSignature": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success {
+			if renesasota.ErrorCode(err) != renesasota.ReasonSignatureInvalid {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), failReason) {
+				t.Errorf("Error should contain master reason: %v", err)
+			}
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 1, 13}) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMaxUpdateTemperature(t *testing.T) {
+	type testData struct {
+		status      int64
+		temperature int32
+		success     bool
+	}
+
+	data := []testData{
+		{status: 0, temperature: 60000, success: true},
+		{status: 3, success: true},
+		{status: 0, temperature: 85500, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Temperature: %d", i)
+
+		payload := bytes.NewBuffer(nil)
+
+		if err := binary.Write(payload, binary.LittleEndian, []int32{item.temperature, 0}); err != nil {
+			t.Fatalf("Can't write payload: %v", err)
+		}
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 16: item.status}, map[int64][]byte{16: payload.Bytes()})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"maxUpdateTemperature": 85}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		_, err = module.Update()
+
+		if item.success && err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if !item.success && (!errors.Is(err, renesasota.ErrOverheated) || !renesasota.IsRetryable(err)) {
+			t.Errorf("Wrong update error: %v", err)
+		}
+
+		expectedCommands := []int64{16}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 2, 3)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestConfirmActiveVersion(t *testing.T) {
+	const updateVersion = "2.1.0"
+
+	type testData struct {
+		activeVersion string
+		success       bool
+	}
+
+	data := []testData{
+		{activeVersion: updateVersion, success: true},
+		{activeVersion: "1.0.0", success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Version: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 18: 0}, map[int64][]byte{18: []byte(item.activeVersion)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"confirmActiveVersion": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, updateVersion, nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		_, err = module.Update()
+
+		expectedVersion := updateVersion
+
+		if !item.success {
+			if renesasota.ErrorCode(err) != renesasota.ReasonVersionMismatch {
+				t.Errorf("Wrong update error: %v", err)
+			}
+
+			expectedVersion = ""
+		} else if err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if version, _ := module.GetVendorVersion(); version != expectedVersion {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestValidateBeforeDownload(t *testing.T) {
+	const failReason = "wrong image header"
+
+	type testData struct {
+		status  int64
+		success bool
+	}
+
+	data := []testData{
+		{status: 0, success: true},
+		{status: 3, success: true},
+		{status: 4, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 19: item.status}, map[int64][]byte{19: []byte(failReason)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"validateBeforeDownload": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success {
+			if renesasota.ErrorCode(err) != renesasota.ReasonValidationFailed {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), failReason) {
+				t.Errorf("Error should contain master reason: %v", err)
+			}
+		}
+
+		expectedCommands := []int64{0, 19}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 1)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestFlushAfterInstall(t *testing.T) {
+	type testData struct {
+		status  int64
+		success bool
+	}
+
+	data := []testData{
+		{status: 0, success: true},
+		{status: 3, success: true},
+		{status: 1, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 12: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"flushAfterInstall": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		_, err = module.Update()
+
+		if item.success && err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if !item.success && err == nil {
+			t.Error("Update should fail")
+		}
+
+		expectedCommands := []int64{2, 12}
+
+		if item.success {
+			expectedCommands = append(expectedCommands, 3)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), expectedCommands) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	type testData struct {
+		statusMap  map[int64]int64
+		payloadMap map[int64][]byte
+		protocol   int
+		success    bool
+	}
+
+	data := []testData{
+		{
+			statusMap: map[int64]int64{11: 0}, payloadMap: map[int64][]byte{11: {1, 0, 0, 0}},
+			protocol: 1, success: true,
+		},
+		{statusMap: map[int64]int64{11: 3}, protocol: 1, success: true},
+		{statusMap: map[int64]int64{}, protocol: 1, success: true},
+		{
+			statusMap: map[int64]int64{11: 0}, payloadMap: map[int64][]byte{11: {99, 0, 0, 0}},
+			protocol: 1, success: false,
+		},
+	}
+
+	for i, item := range data {
+		t.Logf("Negotiate: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, item.statusMap, item.payloadMap)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"negotiateProtocol": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Init()
+
+		if item.success && err != nil {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		if !item.success && renesasota.ErrorCode(err) != renesasota.ReasonProtocolError {
+			t.Errorf("Wrong init error: %v", err)
+		}
+
+		if protocol := module.(*renesasota.RenesasUpdateModule).GetNegotiatedProtocol(); protocol != item.protocol {
+			t.Errorf("Wrong protocol: %d", protocol)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{11}) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestTargetChecksum(t *testing.T) {
+	const imageContent = "this is image content"
+
+	validChecksum := sha256.Sum256([]byte(imageContent))
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	type testData struct {
+		checksums map[string]string
+		success   bool
+	}
+
+	data := []testData{
+		{checksums: map[string]string{targetFile: hex.EncodeToString(validChecksum[:])}, success: true},
+		{checksums: map[string]string{"/other/target.dat": "invalid"}, success: true},
+		{checksums: map[string]string{targetFile: "invalid"}, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Checksum: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(targetFile), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		annotations, err := json.Marshal(map[string]interface{}{"checksums": item.checksums})
+		if err != nil {
+			t.Fatalf("Can't marshal annotations: %v", err)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", annotations)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success {
+			if renesasota.ErrorCode(err) != renesasota.ReasonChecksumMismatch {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+
+			var targetsErr *renesasota.TargetsError
+
+			if !errors.As(err, &targetsErr) || len(targetsErr.Targets) != 1 ||
+				targetsErr.Targets[0].File != targetFile || targetsErr.Targets[0].Err == nil {
+				t.Errorf("Wrong target statuses: %v", err)
+			}
+
+			if _, err = os.Stat(targetFile); !os.IsNotExist(err) {
+				t.Error("Target file should be removed")
+			}
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestImageChecksum(t *testing.T) {
+	const imageContent = "this is image content"
+
+	validChecksum := sha256.Sum256([]byte(imageContent))
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	type testData struct {
+		annotations map[string]interface{}
+		success     bool
+	}
+
+	data := []testData{
+		{success: true},
+		{annotations: map[string]interface{}{"sha256": hex.EncodeToString(validChecksum[:])}, success: true},
+		{annotations: map[string]interface{}{
+			"sha256": hex.EncodeToString(validChecksum[:]), "size": len(imageContent),
+		}, success: true},
+		{annotations: map[string]interface{}{"sha256": "invalid"}, success: false},
+		{annotations: map[string]interface{}{"size": len(imageContent) + 1}, success: false},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	for i, item := range data {
+		t.Logf("Image checksum: %d", i)
+
+		module, err := renesasota.New("test", moduleConfig(targetFile), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		var annotations json.RawMessage
+
+		if item.annotations != nil {
+			if annotations, err = json.Marshal(item.annotations); err != nil {
+				t.Fatalf("Can't marshal annotations: %v", err)
+			}
+		}
+
+		master.getRecvCommands()
+
+		err = module.Prepare(imageFile, "2.1.0", annotations)
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success {
+			if renesasota.ErrorCode(err) != renesasota.ReasonChecksumMismatch {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+
+			if commands := master.getRecvCommands(); len(commands) != 0 {
+				t.Errorf("Unexpected commands: %v", commands)
+			}
+
+			if _, err = os.Stat(targetFile); !os.IsNotExist(err) {
+				t.Error("Target file should be removed")
+			}
+		}
+
+		module.Close()
+	}
+}
+
+func TestAutoDetectCompression(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	gzipImage := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(gzipImage, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	zstdImage := filepath.Join(tmpDir, "image.zst")
+
+	if err = createZstdImage(zstdImage, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		imageFile string
+		content   []byte
+		failed    bool
+	}
+
+	data := []testData{
+		{imageFile: gzipImage},
+		{
+			imageFile: filepath.Join(tmpDir, "image.xz"), content: []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00, 0x00},
+			failed: true,
+		},
+		{imageFile: zstdImage},
+	}
+
+	for i, item := range data {
+		t.Logf("Compression: %d", i)
+
+		if item.content != nil {
+			if err = ioutil.WriteFile(item.imageFile, item.content, 0o600); err != nil {
+				t.Fatalf("Can't create image: %v", err)
+			}
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"autoDetectCompression": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(item.imageFile, "2.1.0", nil)
+
+		if !item.failed && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if item.failed && renesasota.ErrorCode(err) != renesasota.ReasonExtractFailed {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestZstdImage(t *testing.T) {
+	const imageContent = "this is zstd image content"
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	zstdImage := filepath.Join(tmpDir, "image.zst")
+
+	if err = createZstdImage(zstdImage, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	gzipImage := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(gzipImage, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	zstdData, err := ioutil.ReadFile(zstdImage)
+	if err != nil {
+		t.Fatalf("Can't read image: %v", err)
+	}
+
+	corruptedImage := filepath.Join(tmpDir, "corrupted.zst")
+
+	if err = ioutil.WriteFile(corruptedImage, zstdData[:len(zstdData)-3], 0o600); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		imageFile   string
+		compression string
+		errorCode   string
+	}
+
+	data := []testData{
+		{imageFile: zstdImage},
+		{imageFile: zstdImage, compression: "zstd"},
+		{imageFile: gzipImage, compression: "zstd"},
+		{imageFile: zstdImage, compression: "gzip"},
+		{imageFile: corruptedImage, errorCode: renesasota.ReasonArchiveCorrupted},
+	}
+
+	for i, item := range data {
+		t.Logf("Zstd image: %d", i)
+
+		options := map[string]interface{}{"compression": item.compression}
+
+		// Write budget check reads uncompressed image size from zstd header.
+		if item.errorCode == "" {
+			options["dailyWriteBudget"] = 1024
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile, options), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(item.imageFile, "2.1.0", nil)
+
+		if item.errorCode == "" {
+			if err != nil {
+				t.Errorf("Error prepare module: %v", err)
+			}
+
+			content, err := ioutil.ReadFile(targetFile)
+			if err != nil {
+				t.Errorf("Can't read target file: %v", err)
+			}
+
+			if string(content) != imageContent {
+				t.Errorf("Wrong target content: %s", string(content))
+			}
+		}
+
+		if item.errorCode != "" && renesasota.ErrorCode(err) != item.errorCode {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		module.Close()
+	}
+
+	if _, err = renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"compression": "lzma"}), &testStateStorage{}); err == nil {
+		t.Error("Error expected for unsupported compression")
+	}
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	const imageContent = "this is zstd image content"
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	zstdImage := filepath.Join(tmpDir, "image.zst")
+
+	if err = createZstdImage(zstdImage, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"compression": "gzip"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	mismatch := false
+
+	log.AddHook(&testLogHook{message: "Image compression differs", onMessage: func() { mismatch = true }})
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if err = module.Prepare(zstdImage, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if !mismatch {
+		t.Error("Compression mismatch warning expected")
+	}
+
+	content, err := ioutil.ReadFile(targetFile)
+	if err != nil {
+		t.Errorf("Can't read target file: %v", err)
+	}
+
+	if string(content) != imageContent {
+		t.Errorf("Wrong target content: %s", string(content))
+	}
+}
+
+func TestRawImage(t *testing.T) {
+	const imageContent = "this is raw image content"
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	rawImage := filepath.Join(tmpDir, "image.raw")
+
+	if err = ioutil.WriteFile(rawImage, []byte(imageContent), 0o600); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"compression": "none", "dailyWriteBudget": 1024}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	err = module.Prepare(filepath.Join(tmpDir, "absent.raw"), "2.1.0", nil)
+	if renesasota.ErrorCode(err) != renesasota.ReasonExtractFailed {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if err = module.Prepare(rawImage, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(targetFile)
+	if err != nil {
+		t.Fatalf("Can't read target file: %v", err)
+	}
+
+	if string(content) != imageContent {
+		t.Errorf("Wrong target content: %s", string(content))
+	}
+}
+
+func TestTargetSpace(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		size      int64
+		errorCode string
+	}
+
+	data := []testData{
+		{},
+		{size: int64(len("Some image content"))},
+		{size: 1 << 60, errorCode: renesasota.ReasonInsufficientSpace},
+	}
+
+	for i, item := range data {
+		t.Logf("Target space: %d", i)
+
+		if err = os.RemoveAll(targetFile); err != nil {
+			t.Fatalf("Can't remove target file: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(targetFile), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		var annotations json.RawMessage
+
+		if item.size != 0 {
+			annotations = json.RawMessage(fmt.Sprintf(`{"size":%d}`, item.size))
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", annotations)
+
+		if item.errorCode == "" && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if item.errorCode != "" {
+			if renesasota.ErrorCode(err) != item.errorCode {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+
+			if _, err = os.Stat(targetFile); !os.IsNotExist(err) {
+				t.Error("Target file should not be created")
+			}
+		}
+
+		module.Close()
+	}
+}
+
+func TestTargetSpaceExistingTarget(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	var stat syscall.Statfs_t
+
+	if err = syscall.Statfs(tmpDir, &stat); err != nil {
+		t.Fatalf("Can't get file system stat: %v", err)
+	}
+
+	available := int64(stat.Bavail * uint64(stat.Bsize))
+
+	// Sparse target file doesn't occupy space, so crediting its size as available passes the check wrongly
+	if err = ioutil.WriteFile(targetFile, nil, 0o600); err != nil {
+		t.Fatalf("Can't create target file: %v", err)
+	}
+
+	if err = os.Truncate(targetFile, available); err != nil {
+		t.Fatalf("Can't truncate target file: %v", err)
+	}
+	defer os.Remove(targetFile)
+
+	module, err := renesasota.New("test", moduleConfig(targetFile), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	err = module.Prepare(imageFile, "2.1.0", json.RawMessage(fmt.Sprintf(`{"size":%d}`, available+1<<20)))
+	if renesasota.ErrorCode(err) != renesasota.ReasonInsufficientSpace {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+}
+
+func TestRetryOnChecksumMismatch(t *testing.T) {
+	const imageContent = "this is image content"
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	validChecksum := sha256.Sum256([]byte(imageContent))
+	annotations := json.RawMessage(fmt.Sprintf(`{"sha256":"%s"}`, hex.EncodeToString(validChecksum[:])))
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	type testData struct {
+		retries     int
+		transient   bool
+		success     bool
+		mismatches  int
+		createError bool
+	}
+
+	data := []testData{
+		{retries: 0, transient: true, success: false, mismatches: 0},
+		{retries: 2, transient: true, success: true, mismatches: 1},
+		{retries: 2, transient: false, success: false, mismatches: 2},
+		{retries: -1, createError: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Retry on checksum mismatch: %d", i)
+
+		if err = createImage(imageFile, "this is corrupted content"); err != nil {
+			t.Fatalf("Error create image: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"retryOnChecksumMismatch": item.retries}), &testStateStorage{})
+		if item.createError {
+			if err == nil {
+				t.Error("Error expected for wrong retries")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		mismatches := 0
+		transient := item.transient
+
+		// Simulate transient glitch: the source image is fixed when the first mismatch is detected.
+		log.AddHook(&testLogHook{message: "Extracted image mismatch", onMessage: func() {
+			mismatches++
+
+			if transient {
+				if err := createImage(imageFile, imageContent); err != nil {
+					t.Errorf("Error create image: %v", err)
+				}
+			}
+		}})
+
+		err = module.Prepare(imageFile, "2.1.0", annotations)
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if item.success && err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if !item.success && renesasota.ErrorCode(err) != renesasota.ReasonChecksumMismatch {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if mismatches != item.mismatches {
+			t.Errorf("Wrong mismatch retries: %d", mismatches)
+		}
+
+		module.Close()
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	validImage := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(validImage, "this is image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	corruptedImage := filepath.Join(tmpDir, "corrupted.dat")
+
+	if err := ioutil.WriteFile(corruptedImage, []byte("this is not gzip archive"), 0o600); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		imageFile  string
+		targetFile string
+		code       string
+	}
+
+	data := []testData{
+		{
+			imageFile: corruptedImage, targetFile: filepath.Join(tmpDir, "target.dat"),
+			code: renesasota.ReasonArchiveCorrupted,
+		},
+		{imageFile: validImage, targetFile: "/dev/full", code: renesasota.ReasonInsufficientSpace},
+		{
+			imageFile: filepath.Join(tmpDir, "absent.dat"), targetFile: filepath.Join(tmpDir, "target.dat"),
+			code: renesasota.ReasonIOError,
+		},
+	}
+
+	for i, item := range data {
+		t.Logf("Extract: %d", i)
+
+		if item.targetFile != "/dev/full" {
+			if err := ioutil.WriteFile(item.targetFile, []byte("previous image"), 0o600); err != nil {
+				t.Fatalf("Can't create target file: %v", err)
+			}
+		}
+
+		module, err := renesasota.New("test", moduleConfig(item.targetFile), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(item.imageFile, "2.1.0", nil); renesasota.ErrorCode(err) != item.code {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		module.Close()
+
+		if item.targetFile == "/dev/full" {
+			continue
+		}
+
+		if content, err := ioutil.ReadFile(item.targetFile); err != nil || string(content) != "previous image" {
+			t.Errorf("Target file should not be modified by failed extraction: %v", err)
+		}
+
+		if _, err = os.Stat(item.targetFile + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("Temporary target file should be removed: %v", err)
+		}
+	}
+}
+
+func TestStorageRetries(t *testing.T) {
+	errTransient := errors.New("database is locked")
+
+	type testData struct {
+		retries   int
+		getErrors []error
+		success   bool
+	}
+
+	data := []testData{
+		{retries: 0, getErrors: []error{errTransient}, success: false},
+		{retries: 2, getErrors: []error{errTransient, errTransient}, success: true},
+		{retries: 2, getErrors: []error{errTransient, errTransient, errTransient}, success: false},
+		{retries: 2, getErrors: []error{os.ErrPermission}, success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Retries: %d", i)
+
+		storage := &testStateStorage{getErrors: item.getErrors}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"storageRetries": item.retries, "storageRetryDelay": "1ms"}), storage)
+
+		if item.success && err != nil {
+			t.Errorf("Can't create test module: %v", err)
+		}
+
+		if !item.success && err == nil {
+			t.Error("Module creation should fail")
+		}
+
+		if err == nil {
+			module.Close()
+		}
+
+		if item.getErrors[0] == os.ErrPermission && len(storage.getErrors) != 0 {
+			t.Error("Permanent error should not be retried")
+		}
+	}
+}
+
+func TestStateFormat(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	const updateVersion = "2.1.0"
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	if _, err = renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"stateFormat": "xml"}), &testStateStorage{}); err == nil {
+		t.Error("Module creation should fail")
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		format  string
+		options map[string]interface{}
+	}
+
+	data := []testData{
+		{format: "gob", options: map[string]interface{}{}},
+		{format: "gob", options: map[string]interface{}{"stateHmacKey": "secret", "strictStateIntegrity": true}},
+		{format: "cbor", options: map[string]interface{}{}},
+		{format: "cbor", options: map[string]interface{}{"stateHmacKey": "secret", "strictStateIntegrity": true}},
+	}
+
+	for i, item := range data {
+		t.Logf("Format: %d", i)
+
+		options := item.options
+
+		storage := &testStateStorage{}
+
+		// JSON state
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile, options), storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, updateVersion, nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		module.Close()
+
+		// Migrate to binary format
+
+		options["stateFormat"] = item.format
+
+		if module, err = renesasota.New("test", moduleConfigWithOptions(targetFile, options), storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if _, err = module.Update(); err != nil {
+			t.Fatalf("Error update module: %v", err)
+		}
+
+		if storage.state[0] == '{' {
+			t.Errorf("State should be stored in %s format", item.format)
+		}
+
+		module.Close()
+
+		if module, err = renesasota.New("test", moduleConfigWithOptions(targetFile, options), storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if version, _ := module.GetVendorVersion(); version != updateVersion {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+	}
+}
+
+func TestProgressChannel(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New(
+		"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	getPhases := func(progressChannel <-chan renesasota.ProgressEvent) (phases []string) {
+		for event := range progressChannel {
+			phases = append(phases, event.Phase)
+		}
+
+		return phases
+	}
+
+	// Prepare
+
+	progressChannel := module.(*renesasota.RenesasUpdateModule).ProgressChannel()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if phases := getPhases(progressChannel); !reflect.DeepEqual(phases, []string{
+		renesasota.ProgressPhaseExtract, renesasota.ProgressPhaseDownload, renesasota.ProgressPhaseDone,
+	}) {
+		t.Errorf("Wrong prepare progress: %v", phases)
+	}
+
+	// Update
+
+	progressChannel = module.(*renesasota.RenesasUpdateModule).ProgressChannel()
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	if phases := getPhases(progressChannel); !reflect.DeepEqual(phases, []string{
+		renesasota.ProgressPhaseInstall, renesasota.ProgressPhaseActivate, renesasota.ProgressPhaseDone,
+	}) {
+		t.Errorf("Wrong update progress: %v", phases)
+	}
+}
+
+func TestMasterProgress(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if command != 1 {
+			return 0, true
+		}
+
+		for _, percent := range []uint32{25, 50, 100} {
+			frame := bytes.NewBuffer(nil)
+
+			_ = binary.Write(frame, binary.LittleEndian, int64(8))
+			_ = binary.Write(frame, binary.LittleEndian, percent)
+
+			if err := master.sendMQ.Send(frame.Bytes(), 0); err != nil {
+				t.Errorf("Can't send progress frame: %v", err)
+			}
+		}
+
+		return 0, true
+	})
+
+	module, err := renesasota.New(
+		"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	progressChannel := module.(*renesasota.RenesasUpdateModule).ProgressChannel()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	var downloadProgress []int
+
+	for event := range progressChannel {
+		if event.Phase == renesasota.ProgressPhaseDownload {
+			downloadProgress = append(downloadProgress, event.Percent)
+		}
+	}
+
+	if !reflect.DeepEqual(downloadProgress, []int{40, 50, 60, 80}) {
+		t.Errorf("Wrong download progress: %v", downloadProgress)
+	}
+}
+
+func TestReconcileBatchCount(t *testing.T) {
+	type testData struct {
+		processed uint64
+		code      string
+	}
+
+	data := []testData{
+		{processed: 2, code: ""},
+		{processed: 1, code: renesasota.ReasonCommandLost},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Processed: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 14: 0}, map[int64][]byte{14: uint64Payload(item.processed)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"reconcileBatchCount": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); renesasota.ErrorCode(err) != item.code {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 1, 14}) {
+			t.Error("Wrong commands received")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestEffectiveTimeout(t *testing.T) {
+	for _, timeouts := range []map[string]string{{"unknown": "1m"}, {"download": "0s"}, {"install": "-1m"}} {
+		if _, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"commandTimeouts": timeouts}), &testStateStorage{}); err == nil {
+			t.Errorf("Module creation should fail: %v", timeouts)
+		}
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"commandTimeouts": map[string]string{"install": "30m"}}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if timeout := module.(*renesasota.RenesasUpdateModule).GetEffectiveTimeout("install"); timeout != 30*time.Minute {
+		t.Errorf("Wrong install timeout: %v", timeout)
+	}
+
+	if timeout := module.(*renesasota.RenesasUpdateModule).GetEffectiveTimeout("download"); timeout != queueTimeout {
+		t.Errorf("Wrong download timeout: %v", timeout)
+	}
+}
+
+func TestCleanupOrphansOnStart(t *testing.T) {
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	type testData struct {
+		state      []byte
+		maxAge     string
+		fileAge    time.Duration
+		tmpRemoved bool
+	}
+
+	data := []testData{
+		{state: nil, maxAge: "0s", tmpRemoved: true},
+		{state: nil, maxAge: "1h"},
+		{state: nil, fileAge: time.Minute},
+		{state: nil, fileAge: 2 * time.Hour, tmpRemoved: true},
+		{state: []byte(`{"state":1}`), maxAge: "0s", tmpRemoved: true},
+		{state: []byte(`{"state":0,"uploadedChunks":2}`), maxAge: "0s", tmpRemoved: true},
+		{state: []byte(`{"state":0,"extractedImage":{"source":"image.dat"}}`), maxAge: "0s", tmpRemoved: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Cleanup: %d", i)
+
+		for _, file := range []string{targetFile, targetFile + ".tmp"} {
+			if err := ioutil.WriteFile(file, []byte("partial"), 0o600); err != nil {
+				t.Fatalf("Can't create file: %v", err)
+			}
+
+			modTime := time.Now().Add(-item.fileAge)
+
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatalf("Can't set file time: %v", err)
+			}
+		}
+
+		options := map[string]interface{}{"cleanupOrphansOnStart": true}
+
+		if item.maxAge != "" {
+			options["orphanMaxAge"] = item.maxAge
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile, options),
+			&testStateStorage{state: item.state})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if _, err = os.Stat(targetFile); err != nil {
+			t.Errorf("Target file should not be removed: %v", err)
+		}
+
+		if _, err = os.Stat(targetFile + ".tmp"); (err != nil) != item.tmpRemoved {
+			t.Errorf("Wrong tmp file existence: %v", err)
+		}
+
+		module.Close()
+	}
+
+	os.RemoveAll(targetFile + ".tmp")
+}
+
+func TestWorkDir(t *testing.T) {
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	workDir := filepath.Join(tmpDir, "work")
+	tmpFile := filepath.Join(workDir, "target.dat.tmp")
+
+	if err := ioutil.WriteFile(workDir, nil, 0o600); err != nil {
+		t.Fatalf("Can't create file: %v", err)
+	}
+
+	if _, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"workDir": filepath.Join(workDir, "work")}), &testStateStorage{}); err == nil {
+		t.Error("Module creation with invalid work dir should fail")
+	}
+
+	if err := os.RemoveAll(workDir); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"workDir": workDir}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	module.Close()
+
+	if info, err := os.Stat(workDir); err != nil || !info.IsDir() {
+		t.Fatalf("Work dir is not created: %v", err)
+	}
+
+	if err = ioutil.WriteFile(tmpFile, []byte("partial"), 0o600); err != nil {
+		t.Fatalf("Can't create file: %v", err)
+	}
+
+	if module, err = renesasota.New("test", moduleConfigWithOptions(targetFile, map[string]interface{}{
+		"workDir": workDir, "cleanupOrphansOnStart": true, "orphanMaxAge": "0s",
+	}), &testStateStorage{}); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	module.Close()
+
+	if _, err = os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Errorf("Temporary target file should be removed: %v", err)
+	}
+}
+
+func TestReplaceTargetAcrossFileSystems(t *testing.T) {
+	const imageContent = "Some image content"
+
+	workDir, err := ioutil.TempDir("/dev/shm", "um_")
+	if err != nil {
+		t.Skipf("Can't create work dir: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var workStat, targetStat syscall.Stat_t
+
+	if err = syscall.Stat(workDir, &workStat); err != nil {
+		t.Fatalf("Can't stat work dir: %v", err)
+	}
+
+	if err = syscall.Stat(tmpDir, &targetStat); err != nil {
+		t.Fatalf("Can't stat target dir: %v", err)
+	}
+
+	if workStat.Dev == targetStat.Dev {
+		t.Skip("Work dir and target dir are on the same file system")
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = ioutil.WriteFile(targetFile, []byte("active image"), 0o600); err != nil {
+		t.Fatalf("Can't create target file: %v", err)
+	}
+	defer os.Remove(targetFile)
+
+	// Target file is not touched if the image can't be copied next to it
+
+	if err = os.Mkdir(targetFile+".tmp", 0o700); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"workDir": workDir}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Prepare should fail")
+	}
+
+	if data, err := ioutil.ReadFile(targetFile); err != nil || string(data) != "active image" {
+		t.Errorf("Wrong target file content: %s, %v", string(data), err)
+	}
+
+	if err = os.Remove(targetFile + ".tmp"); err != nil {
+		t.Fatalf("Can't remove dir: %v", err)
+	}
+
+	// Target file is replaced by the image copied across file systems
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if data, err := ioutil.ReadFile(targetFile); err != nil || string(data) != imageContent {
+		t.Errorf("Wrong target file content: %s, %v", string(data), err)
+	}
+
+	if _, err = os.Stat(targetFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary target file should be removed: %v", err)
+	}
+}
+
+func TestReboot(t *testing.T) {
+	type testData struct {
+		status        int64
+		rebootCommand string
+		rebootTimeout string
+		err           bool
+	}
+
+	data := []testData{
+		{status: 0},
+		{status: 1, err: true},
+		{status: 3, err: true},
+		{rebootCommand: "true"},
+		{rebootCommand: "false", err: true},
+		{rebootCommand: "exec sleep 5", rebootTimeout: "100ms", err: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Reboot: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{32: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		options := map[string]interface{}{"rebootCommand": item.rebootCommand}
+
+		if item.rebootTimeout != "" {
+			options["rebootTimeout"] = item.rebootTimeout
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"), options),
+			&testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Reboot(); (err != nil) != item.err {
+			t.Errorf("Wrong reboot error: %v", err)
+		}
+
+		expectedCommands := []int64{32}
+
+		if item.rebootCommand != "" {
+			expectedCommands = nil
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestConfirmReboot(t *testing.T) {
+	type testData struct {
+		requestedAt     time.Time
+		failUnconfirmed bool
+		err             error
+	}
+
+	data := []testData{
+		{requestedAt: time.Now().Add(-24 * 365 * 100 * time.Hour)},
+		{requestedAt: time.Now()},
+		{requestedAt: time.Now(), failUnconfirmed: true, err: renesasota.ErrRebootNotConfirmed},
+	}
+
+	for i, item := range data {
+		t.Logf("Confirm reboot: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		storage := &testStateStorage{}
+		config := moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"), map[string]interface{}{
+			"rebootCommand": "true", "confirmReboot": true, "failUnconfirmedReboot": item.failUnconfirmed,
+		})
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		module.(*renesasota.RenesasUpdateModule).SetClock(&testClock{now: item.requestedAt})
+
+		if err = module.Reboot(); err != nil {
+			t.Errorf("Error reboot module: %v", err)
+		}
+
+		module.Close()
+
+		// Restart
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Init(); !errors.Is(err, item.err) {
+			t.Errorf("Wrong init error: %v", err)
+		}
+
+		module.Close()
+
+		// Reboot is confirmed once
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Init(); err != nil {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestIsRebootSafe(t *testing.T) {
+	const flashReason = "flash write in progress"
+
+	type testData struct {
+		status  int64
+		payload []byte
+		safe    bool
+		reason  string
+	}
+
+	data := []testData{
+		{status: 0, payload: []byte{1, 0, 0, 0}, safe: true},
+		{status: 0, payload: append([]byte{0, 0, 0, 0}, flashReason...), safe: false, reason: flashReason},
+		{status: 3, safe: true, reason: "OTA master doesn't report reboot safety"},
+	}
+
+	for i, item := range data {
+		t.Logf("Reboot safety: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{21: item.status}, map[int64][]byte{21: item.payload})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New(
+			"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		safe, reason, err := module.(*renesasota.RenesasUpdateModule).IsRebootSafe()
+		if err != nil {
+			t.Errorf("Can't get reboot safety: %v", err)
+		}
+
+		if safe != item.safe || reason != item.reason {
+			t.Errorf("Wrong reboot safety: %v, %s", safe, reason)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestGuardActiveTarget(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	const targetContent = "target in use"
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err = ioutil.WriteFile(targetFile, []byte(targetContent), 0o600); err != nil {
+		t.Fatalf("Can't create target file: %v", err)
+	}
+
+	file, err := os.Open(targetFile)
+	if err != nil {
+		t.Fatalf("Can't open target file: %v", err)
+	}
+	defer file.Close()
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		t.Fatalf("Can't lock target file: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"guardActiveTarget": true}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); !errors.Is(err, renesasota.ErrTargetInUse) {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if content, _ := ioutil.ReadFile(targetFile); string(content) != targetContent {
+		t.Error("Target file should not be truncated")
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatalf("Can't unlock target file: %v", err)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	// Missing target file is not created by the guard
+
+	if err = os.Remove(targetFile); err != nil {
+		t.Fatalf("Can't remove target file: %v", err)
+	}
+
+	if module, err = renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"guardActiveTarget": true}), &testStateStorage{}); err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(filepath.Join(tmpDir, "missing.dat"), "2.1.0", nil); err == nil {
+		t.Error("Prepare should fail")
+	}
+
+	if _, err = os.Stat(targetFile); !os.IsNotExist(err) {
+		t.Errorf("Target file should not be created: %v", err)
+	}
+}
+
+func TestExtractionConcurrency(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	renesasota.SetExtractionConcurrency(1)
+	defer renesasota.SetExtractionConcurrency(0)
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		module, err := renesasota.New(fmt.Sprintf("test%d", i),
+			moduleConfig(filepath.Join(tmpDir, fmt.Sprintf("target%d.dat", i))), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		done := make(chan error, 1)
+
+		go func() { done <- module.Prepare(imageFile, "2.1.0", nil) }()
+
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Errorf("Error prepare module: %v", err)
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("Prepare blocked by extraction limit")
+		}
+
+		module.Close()
+	}
+}
+
+func TestMasterFingerprint(t *testing.T) {
+	const fingerprint = "0a1b2c3d"
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{22: 0}, map[int64][]byte{22: []byte(fingerprint)})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New(
+		"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	for i := 0; i < 2; i++ {
+		value, err := module.(*renesasota.RenesasUpdateModule).GetMasterFingerprint()
+		if err != nil {
+			t.Errorf("Can't get master fingerprint: %v", err)
+		}
+
+		if value != fingerprint {
+			t.Errorf("Wrong master fingerprint: %s", value)
+		}
+	}
+
+	if !reflect.DeepEqual(master.getRecvCommands(), []int64{22}) {
+		t.Error("Wrong commands received")
+	}
+}
+
+func TestMasterLastGoodVersion(t *testing.T) {
+	type testData struct {
+		status  int64
+		version string
+		err     error
+	}
+
+	data := []testData{
+		{status: 0, version: "1.0.0"},
+		{status: 3, err: renesasota.ErrUnsupported},
+	}
+
+	for i, item := range data {
+		t.Logf("Last good version: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{24: item.status}, map[int64][]byte{24: []byte(item.version)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New(
+			"test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		version, err := module.(*renesasota.RenesasUpdateModule).GetMasterLastGoodVersion()
+		if !errors.Is(err, item.err) {
+			t.Errorf("Wrong error: %v", err)
+		}
+
+		if version != item.version {
+			t.Errorf("Wrong last good version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestReconcileOnInit(t *testing.T) {
+	type testData struct {
+		state       string
+		status      int64
+		masterState uint32
+		version     string
+	}
+
+	data := []testData{
+		{state: `{"state":1,"vendorVersion":"1.0.0","pendingVersion":"2.0.0"}`, masterState: 0, version: "1.0.0"},
+		{state: `{"state":1,"vendorVersion":"1.0.0","pendingVersion":"2.0.0"}`, masterState: 3, version: "2.0.0"},
+		{state: `{"state":2,"vendorVersion":"2.0.0","pendingVersion":"1.0.0"}`, masterState: 1, version: "1.0.0"},
+		{state: `{"state":2,"vendorVersion":"2.0.0","pendingVersion":"1.0.0"}`, masterState: 3, version: "2.0.0"},
+		{state: `{"state":1,"vendorVersion":"1.0.0","pendingVersion":"2.0.0"}`, status: 3, version: "1.0.0"},
+	}
+
+	for i, item := range data {
+		t.Logf("Reconcile: %d", i)
+
+		payload := bytes.NewBuffer(nil)
+
+		if err := binary.Write(payload, binary.LittleEndian, item.masterState); err != nil {
+			t.Fatalf("Can't write payload: %v", err)
+		}
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{20: item.status, 34: 3, 18: 3}, map[int64][]byte{20: payload.Bytes()})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"reconcileOnInit": true}), &testStateStorage{state: []byte(item.state)})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Init(); err != nil {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		if version, _ := module.GetVendorVersion(); version != item.version {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestResponseValidator(t *testing.T) {
+	const customSuccess = 7
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: customSuccess, 1: customSuccess}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Prepare should fail with built-in status parsing")
+	}
+
+	var validatedCommands []string
+
+	module.(*renesasota.RenesasUpdateModule).SetResponseValidator(
+		func(command string, recvData []byte) (success bool, err error) {
+			validatedCommands = append(validatedCommands, command)
+
+			if len(recvData) != 8 {
+				return false, aoserrors.New("wrong response size")
+			}
+
+			return binary.LittleEndian.Uint64(recvData) == customSuccess, nil
+		})
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	if !reflect.DeepEqual(validatedCommands, []string{"syncCompose", "download"}) {
+		t.Errorf("Wrong validated commands: %v", validatedCommands)
+	}
+}
+
+func TestDailyWriteBudget(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"dailyWriteBudget": 30}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	clock := &testClock{now: time.Now()}
+
+	module.(*renesasota.RenesasUpdateModule).SetClock(clock)
+
+	type testData struct {
+		annotations json.RawMessage
+		elapsed     time.Duration
+		err         error
+	}
+
+	data := []testData{
+		{},
+		{err: renesasota.ErrWriteBudgetExceeded},
+		{annotations: json.RawMessage(`{"ignoreWriteBudget":true}`)},
+		{elapsed: 23 * time.Hour, err: renesasota.ErrWriteBudgetExceeded},
+		{elapsed: 2 * time.Hour},
+	}
+
+	for i, item := range data {
+		t.Logf("Prepare: %d", i)
+
+		clock.now = clock.now.Add(item.elapsed)
+
+		if err = module.Prepare(imageFile, "2.1.0", item.annotations); !errors.Is(err, item.err) {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if _, err = module.Revert(); err != nil {
+			t.Errorf("Error revert module: %v", err)
+		}
+	}
+
+	// Each extraction attempt is charged, including failed retries
+
+	retryModule, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"dailyWriteBudget": 50, "retryOnChecksumMismatch": 2}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer retryModule.Close()
+
+	wrongChecksum := json.RawMessage(fmt.Sprintf(`{"sha256":"%s"}`, strings.Repeat("0", 64)))
+
+	if err = retryModule.Prepare(imageFile, "2.1.0", wrongChecksum); renesasota.ErrorCode(err) !=
+		renesasota.ReasonChecksumMismatch {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if err = retryModule.Prepare(imageFile, "2.1.0", nil); !errors.Is(err, renesasota.ErrWriteBudgetExceeded) {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+
+	targetFile := filepath.Join(tmpDir, "target.dat")
+	storage := &testStateStorage{}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+		map[string]interface{}{"readyCacheTtl": "1m"}), storage)
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	clock := &testClock{now: time.Now()}
+	renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+	renesasModule.SetClock(clock)
+
+	if !renesasModule.Ready() {
+		t.Error("Module should be ready")
+	}
+
+	master.close()
+
+	if !renesasModule.Ready() {
+		t.Error("Cached ready result expected")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+
+	if renesasModule.Ready() {
+		t.Error("Module should not be ready without queues")
+	}
+
+	if master, err = newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil); err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	if err = ioutil.WriteFile(targetFile+".tmp", nil, 0o600); err != nil {
+		t.Fatalf("Can't create temporary target file: %v", err)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+
+	if renesasModule.Ready() {
+		t.Error("Module should not be ready with orphaned temporary file")
+	}
+
+	if err = os.Remove(targetFile + ".tmp"); err != nil {
+		t.Fatalf("Can't remove temporary target file: %v", err)
+	}
+
+	// Temporary file of running extraction doesn't affect readiness
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	extracting, readyDuringExtraction := false, false
+
+	log.AddHook(&testLogHook{message: "Copy partition from archive", onMessage: func() {
+		if _, err := os.Stat(targetFile + ".tmp"); err == nil {
+			extracting = true
+		}
+
+		clock.now = clock.now.Add(time.Minute)
+		readyDuringExtraction = renesasModule.Ready()
+	}})
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if !extracting {
+		t.Error("Temporary target file should exist during extraction")
+	}
+
+	if !readyDuringExtraction {
+		t.Error("Module should be ready during extraction")
+	}
+
+	storage.getErrors = []error{aoserrors.New("storage error")}
+	clock.now = clock.now.Add(time.Minute)
+
+	if renesasModule.Ready() {
+		t.Error("Module should not be ready with inaccessible storage")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+
+	if !renesasModule.Ready() {
+		t.Error("Module should be ready")
+	}
+}
+
+func TestStrictVersioning(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{2: 0, 3: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		strict   bool
+		failed   bool
+		commands []int64
+	}
+
+	data := []testData{
+		{strict: true, failed: true, commands: nil},
+		{strict: false, failed: false, commands: []int64{2, 3}},
+	}
+
+	for i, item := range data {
+		t.Logf("Strict versioning: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"strictVersioning": item.strict}),
+			&testStateStorage{state: []byte(`{"state":1,"vendorVersion":"1.0.0"}`)})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if _, err = module.Update(); (err != nil) != item.failed {
+			t.Errorf("Wrong update error: %v", err)
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, item.commands) {
+			t.Errorf("Wrong commands: %v", commands)
+		}
+
+		module.Close()
+	}
+}
+
+func TestSerializeOperations(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	release := make(chan struct{})
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if command == 1 {
+			<-release
+		}
+
+		return 0, true
+	})
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"serializeOperations": true}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+	waitPending := func(pending int) {
+		for i := 0; renesasModule.PendingOperations() != pending; i++ {
+			if i > 100 {
+				t.Fatalf("Wrong pending operations: %d", renesasModule.PendingOperations())
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	prepareResult := make(chan error, 1)
+	revertResult := make(chan error, 1)
+
+	go func() { prepareResult <- module.Prepare(imageFile, "2.1.0", nil) }()
+
+	waitPending(1)
+
+	go func() {
+		_, err := module.Revert()
+		revertResult <- err
+	}()
+
+	waitPending(2)
+
+	release <- struct{}{}
+
+	if err = <-prepareResult; err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	if err = <-revertResult; err != nil {
+		t.Errorf("Error revert module: %v", err)
+	}
+
+	if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, []int64{0, 1, 4}) {
+		t.Errorf("Wrong commands: %v", commands)
+	}
+
+	// Apply and reboot are queued as other operations
+
+	updateResult := make(chan error, 1)
+	applyResult := make(chan error, 1)
+	rebootResult := make(chan error, 1)
+
+	go func() { prepareResult <- module.Prepare(imageFile, "2.1.0", nil) }()
+
+	waitPending(1)
+
+	go func() {
+		_, err := module.Update()
+		updateResult <- err
+	}()
+
+	waitPending(2)
+
+	go func() {
+		_, err := module.Apply()
+		applyResult <- err
+	}()
+
+	waitPending(3)
+
+	go func() { rebootResult <- module.Reboot() }()
+
+	waitPending(4)
+
+	release <- struct{}{}
+
+	for _, result := range []chan error{prepareResult, updateResult, applyResult, rebootResult} {
+		if err = <-result; err != nil {
+			t.Errorf("Operation error: %v", err)
+		}
+	}
+
+	if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, []int64{0, 1, 2, 3, 32}) {
+		t.Errorf("Wrong commands: %v", commands)
+	}
+
+	// Close cancels queued operations
+
+	go func() { prepareResult <- module.Prepare(imageFile, "2.1.0", nil) }()
+
+	waitPending(1)
+
+	go func() {
+		_, err := module.Update()
+		updateResult <- err
+	}()
+
+	waitPending(2)
+
+	closeResult := make(chan error, 1)
+
+	go func() { closeResult <- module.Close() }()
+
+	if err = <-updateResult; !errors.Is(err, renesasota.ErrModuleClosed) {
+		t.Errorf("Wrong update error: %v", err)
+	}
+
+	release <- struct{}{}
+
+	if err = <-prepareResult; err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	if err = <-closeResult; err != nil {
+		t.Errorf("Error close module: %v", err)
+	}
+
+	if _, err = module.Revert(); !errors.Is(err, renesasota.ErrModuleClosed) {
+		t.Errorf("Wrong revert error: %v", err)
+	}
+}
+
+func TestRemoteImage(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 4: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageDir := filepath.Join(tmpDir, "remote")
+
+	if err = os.MkdirAll(imageDir, 0o700); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+
+	if err = createImage(filepath.Join(imageDir, "image.dat"), "Remote image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	imageData, err := ioutil.ReadFile(filepath.Join(imageDir, "image.dat"))
+	if err != nil {
+		t.Fatalf("Can't read image: %v", err)
+	}
+
+	checksum := sha256.Sum256(imageData)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(imageDir)))
+	defer server.Close()
+
+	type testData struct {
+		allowRemote bool
+		imageURL    string
+		annotations json.RawMessage
+		failed      bool
+		errorCode   string
+	}
+
+	data := []testData{
+		{allowRemote: false, imageURL: server.URL + "/image.dat", failed: true},
+		{allowRemote: true, imageURL: server.URL + "/image.dat"},
+		{
+			allowRemote: true, imageURL: server.URL + "/image.dat",
+			annotations: json.RawMessage(fmt.Sprintf(`{"imageChecksum":"%s"}`, hex.EncodeToString(checksum[:]))),
+		},
+		{
+			allowRemote: true, imageURL: server.URL + "/image.dat",
+			annotations: json.RawMessage(`{"imageChecksum":"0000"}`), failed: true,
+			errorCode: renesasota.ReasonChecksumMismatch,
+		},
+		{
+			allowRemote: true, imageURL: server.URL + "/missing.dat", failed: true,
+			errorCode: renesasota.ReasonFetchFailed,
+		},
+	}
+
+	for i, item := range data {
+		t.Logf("Remote image: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"allowRemoteImages": item.allowRemote}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Prepare(item.imageURL, "2.1.0", item.annotations)
+		if (err != nil) != item.failed {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if item.errorCode != "" && renesasota.ErrorCode(err) != item.errorCode {
+			t.Errorf("Wrong error code: %s", renesasota.ErrorCode(err))
+		}
+
+		if err == nil {
+			if content, _ := ioutil.ReadFile(filepath.Join(tmpDir, "target.dat")); string(content) !=
+				"Remote image content" {
+				t.Errorf("Wrong target content: %s", content)
+			}
+
+			if path := module.(*renesasota.RenesasUpdateModule).GetLastImagePath(); path != item.imageURL {
+				t.Errorf("Wrong last image path: %s", path)
+			}
+
+			if _, err = module.Revert(); err != nil {
+				t.Errorf("Error revert module: %v", err)
+			}
+		}
+
+		module.Close()
+	}
+}
+
+func TestRemoteImageCancel(t *testing.T) {
+	released := make(chan struct{})
+
+	// Server never responds until the request is canceled
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-released:
+		}
+	}))
+	defer server.Close()
+	defer close(released)
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"allowRemoteImages": true, "remoteImageTimeout": "1m"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	err = module.(*renesasota.RenesasUpdateModule).PrepareWithContext(ctx, server.URL+"/image.dat", "2.1.0", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if renesasota.ErrorCode(err) != renesasota.ReasonFetchFailed {
+		t.Errorf("Wrong error code: %s", renesasota.ErrorCode(err))
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Remote image fetch is not canceled in time: %v", elapsed)
+	}
+}
+
+func TestOperationPanic(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageDir := filepath.Join(tmpDir, "remote")
+	workDir := filepath.Join(tmpDir, "work")
+
+	if err = os.MkdirAll(imageDir, 0o700); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+
+	if err = createImage(filepath.Join(imageDir, "image.dat"), "Remote image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(imageDir)))
+	defer server.Close()
+
+	for _, serialize := range []bool{false, true} {
+		t.Logf("Serialize operations: %v", serialize)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{
+				"allowRemoteImages": true, "workDir": workDir, "serializeOperations": serialize,
+			}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+		renesasModule.SetResponseValidator(func(command string, recvData []byte) (bool, error) {
+			panic("validator failure")
+		})
+
+		if err = module.Prepare(server.URL+"/image.dat", "2.1.0", nil); err == nil ||
+			!strings.Contains(err.Error(), "validator failure") {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		entries, err := ioutil.ReadDir(workDir)
+		if err != nil {
+			t.Fatalf("Can't read work dir: %v", err)
+		}
+
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "fetch") {
+				t.Errorf("Fetch dir is not removed: %s", entry.Name())
+			}
+		}
+
+		renesasModule.SetResponseValidator(nil)
+
+		if err = module.Prepare(server.URL+"/image.dat", "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestProtocolStats(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 5: 3}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		persist       bool
+		restoredStats renesasota.ProtocolStats
+	}
+
+	data := []testData{
+		{persist: false},
+		{persist: true, restoredStats: renesasota.ProtocolStats{CommandsSent: 2, BytesTransferred: 32}},
+	}
+
+	for i, item := range data {
+		t.Logf("Persist stats: %d", i)
+
+		storage := &testStateStorage{}
+		config := moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"persistStats": item.persist})
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.(*renesasota.RenesasUpdateModule).GetMasterVersion(); err == nil {
+			t.Error("Get master version should fail")
+		}
+
+		if _, err = module.(*renesasota.RenesasUpdateModule).GetFreeSpace(); !errors.Is(err, renesasota.ErrTimeout) {
+			t.Errorf("Wrong get free space error: %v", err)
+		}
+
+		expectedStats := renesasota.ProtocolStats{CommandsSent: 4, Failures: 2, Timeouts: 1, BytesTransferred: 56}
+
+		if stats := module.(*renesasota.RenesasUpdateModule).GetProtocolStats(); stats != expectedStats {
+			t.Errorf("Wrong protocol stats: %+v", stats)
+		}
+
+		module.Close()
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if stats := module.(*renesasota.RenesasUpdateModule).GetProtocolStats(); stats != item.restoredStats {
+			t.Errorf("Wrong restored protocol stats: %+v", stats)
+		}
+
+		module.Close()
+	}
+}
+
+func TestVerifyEachChunk(t *testing.T) {
+	const (
+		imageContent = "0123456789abcdefghij"
+		chunkSize    = 8
+	)
+
+	type testData struct {
+		verifyStatus int64
+		commands     []int64
+	}
+
+	data := []testData{
+		{verifyStatus: 0, commands: []int64{0, 9, 25, 9, 25, 9, 25, 9, 25, 1}},
+		{verifyStatus: 3, commands: []int64{0, 9, 25, 9, 9, 1}},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Verify chunk: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		corrupted := false
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command != 25 {
+				return 0, true
+			}
+
+			var request struct{ Index, CRC uint32 }
+
+			if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, &request); err != nil {
+				t.Errorf("Can't read verify request: %v", err)
+			}
+
+			if item.verifyStatus == 0 && request.Index == 1 && !corrupted {
+				corrupted = true
+
+				return 6, true
+			}
+
+			return item.verifyStatus, true
+		})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"uploadChunkSize": chunkSize, "verifyEachChunk": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, item.commands) {
+			t.Errorf("Wrong commands: %v", commands)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMasterVerboseDuringUpdate(t *testing.T) {
+	type testData struct {
+		verboseStatus int64
+		wasVerbose    uint32
+		settings      []uint32
+	}
+
+	data := []testData{
+		{verboseStatus: 0, wasVerbose: 0, settings: []uint32{1, 0, 1, 0}},
+		{verboseStatus: 0, wasVerbose: 1, settings: []uint32{1, 1}},
+		{verboseStatus: 3, settings: []uint32{1, 1}},
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for i, item := range data {
+		t.Logf("Verbose: %d", i)
+
+		var settings []uint32
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil,
+			map[int64][]byte{26: uint64Payload(uint64(item.wasVerbose))[:4]})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command != 26 {
+				return 0, true
+			}
+
+			settings = append(settings, binary.LittleEndian.Uint32(payload))
+
+			return item.verboseStatus, true
+		})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"masterVerboseDuringUpdate": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if !reflect.DeepEqual(settings, item.settings) {
+			t.Errorf("Wrong verbose settings: %v", settings)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestPersistentQueues(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{5: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+
+	initialFDs := countOpenFiles(t)
+
+	if err = module.Init(); err != nil {
+		t.Fatalf("Error init module: %v", err)
+	}
+
+	if fds := countOpenFiles(t); fds != initialFDs+2 {
+		t.Errorf("Wrong number of open files after init: %d", fds)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err = module.(*renesasota.RenesasUpdateModule).GetMasterVersion(); err != nil {
+			t.Errorf("Can't get master version: %v", err)
+		}
+	}
+
+	if fds := countOpenFiles(t); fds != initialFDs+2 {
+		t.Errorf("Wrong number of open files after commands: %d", fds)
+	}
+
+	module.Close()
+
+	if fds := countOpenFiles(t); fds != initialFDs {
+		t.Errorf("Wrong number of open files after close: %d", fds)
+	}
+}
+
+func TestPrepareCancel(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		return 0, command != 1
+	})
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"timeout": "1m"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	err = module.(*renesasota.RenesasUpdateModule).PrepareWithContext(ctx, imageFile, "2.1.0", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wrong prepare error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Prepare is not canceled in time: %v", elapsed)
+	}
+
+	_, err = module.(*renesasota.RenesasUpdateModule).RevertWithContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wrong revert error: %v", err)
+	}
+}
+
+func TestResponseDeadlineClock(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		time.Sleep(50 * time.Millisecond)
+
+		return 0, true
+	})
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"timeout": "5s"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	// Module clock lags behind the system time: the response deadline is still counted by the module clock
+	module.(*renesasota.RenesasUpdateModule).SetClock(&testClock{now: time.Now().Add(-time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err = module.(*renesasota.RenesasUpdateModule).PrepareWithContext(ctx, imageFile, "2.1.0", nil); err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+}
+
+func TestRequireMasterProtocol(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{11: 0}, map[int64][]byte{11: {1, 0, 0, 0}})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		minProtocol int
+		maxProtocol int
+		success     bool
+	}
+
+	data := []testData{
+		{success: true},
+		{minProtocol: 1, maxProtocol: 1, success: true},
+		{minProtocol: 1, success: true},
+		{minProtocol: 2, maxProtocol: 3, success: false},
+		{maxProtocol: 1, success: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Require protocol: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{
+				"negotiateProtocol": true, "minMasterProtocol": item.minProtocol, "maxMasterProtocol": item.maxProtocol,
+			}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.Init()
+
+		if item.success && err != nil {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		if !item.success && renesasota.ErrorCode(err) != renesasota.ReasonProtocolError {
+			t.Errorf("Wrong init error: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestOperationID(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+	var commandIDs []string
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		commandIDs = append(commandIDs, renesasModule.CurrentOperationID())
+
+		return 0, true
+	})
+
+	progressChannel := renesasModule.ProgressChannel()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	for event := range progressChannel {
+		if event.OperationID != commandIDs[0] {
+			t.Errorf("Wrong progress event operation ID: %s", event.OperationID)
+		}
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	if len(commandIDs) != 4 || commandIDs[0] == "" || commandIDs[0] != commandIDs[1] ||
+		commandIDs[2] == commandIDs[1] || commandIDs[2] != commandIDs[3] {
+		t.Errorf("Wrong operation IDs: %v", commandIDs)
+	}
+
+	if id := renesasModule.CurrentOperationID(); id != "" {
+		t.Errorf("Unexpected operation ID: %s", id)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	master.setByteOrder(binary.BigEndian)
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) { return 0, true })
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if _, err = renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"byteOrder": "middle"}), &testStateStorage{}); err == nil {
+		t.Error("Error expected for unsupported byte order")
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"byteOrder": "big"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	commands := master.getRecvCommands()
+	if len(commands) == 0 {
+		t.Fatal("No commands received")
+	}
+
+	for _, command := range commands {
+		if command < 0 || command > 0xFF {
+			t.Errorf("Wrong command received: %d", command)
+		}
+	}
+}
+
+func TestMasterTransaction(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		failedCommand int64
+		prepareError  bool
+		updateError   bool
+		txnCommands   []int64
+	}
+
+	data := []testData{
+		{failedCommand: -1, txnCommands: []int64{27, 28}},
+		{failedCommand: 1, prepareError: true, txnCommands: []int64{27, 29}},
+		{failedCommand: 2, updateError: true, txnCommands: []int64{27, 29}},
+		{failedCommand: 28, updateError: true, txnCommands: []int64{27, 28, 29}},
+		{failedCommand: 27, prepareError: true, txnCommands: []int64{27}},
+	}
+
+	for i, item := range data {
+		t.Logf("Master transaction: %d", i)
+
+		failedCommand := item.failedCommand
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command == failedCommand {
+				return 1, true
+			}
+
+			return 0, true
+		})
+
+		storage := &testStateStorage{}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"useMasterTransaction": true}), storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+		if (err != nil) != item.prepareError {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if err == nil {
+			if _, err = module.Update(); (err != nil) != item.updateError {
+				t.Errorf("Wrong update error: %v", err)
+			}
+		}
+
+		var txnCommands []int64
+
+		for _, command := range master.getRecvCommands() {
+			if command >= 27 && command <= 29 {
+				txnCommands = append(txnCommands, command)
+			}
+		}
+
+		if !reflect.DeepEqual(txnCommands, item.txnCommands) {
+			t.Errorf("Wrong transaction commands: %v", txnCommands)
+		}
+
+		if strings.Contains(string(storage.state), "txnOpen") {
+			t.Error("Transaction should be closed")
+		}
+
+		module.Close()
+	}
+}
+
+func TestMasterTransactionDeadline(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		noReplyCommand int64
+		update         bool
+	}
+
+	data := []testData{
+		{noReplyCommand: 27},
+		{noReplyCommand: 1},
+		{noReplyCommand: 37, update: true},
+		{noReplyCommand: 2, update: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Master transaction deadline: %d", i)
+
+		noReplyCommand := item.noReplyCommand
+
+		// Master doesn't reply until the operation deadline expires
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			return 0, command != noReplyCommand
+		})
+
+		storage := &testStateStorage{}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"useMasterTransaction": true, "timeout": "5s", "masterDeadline": "1m"}), storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+		master.getRecvCommands()
+
+		rollbackFailed := false
+
+		log.AddHook(&testLogHook{message: "Can't rollback", onMessage: func() { rollbackFailed = true }})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+
+		if item.update {
+			if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+				t.Errorf("Error prepare module: %v", err)
+			}
+
+			_, err = renesasModule.UpdateWithContext(ctx)
+		} else {
+			err = renesasModule.PrepareWithContext(ctx, imageFile, "2.1.0", nil)
+		}
+
+		cancel()
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Wrong operation error: %v", err)
+		}
+
+		var txnCommands []int64
+
+		for _, command := range master.getRecvCommands() {
+			if command >= 27 && command <= 29 {
+				txnCommands = append(txnCommands, command)
+			}
+		}
+
+		if !reflect.DeepEqual(txnCommands, []int64{27, 29}) {
+			t.Errorf("Wrong transaction commands: %v", txnCommands)
+		}
+
+		if rollbackFailed {
+			t.Error("Transaction rollback failed")
+		}
+
+		if strings.Contains(string(storage.state), "txnOpen") {
+			t.Error("Transaction should be closed")
+		}
+
+		module.Close()
+	}
+}
+
+func TestDrainStaleResponses(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	// Stale failed status of the command sent before restart.
+	frame := bytes.NewBuffer(nil)
+
+	_ = binary.Write(frame, binary.LittleEndian, int64(1))
+
+	if err = master.sendMQ.Send(frame.Bytes(), 0); err != nil {
+		t.Fatalf("Can't send stale frame: %v", err)
+	}
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		return 0, true
+	})
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+}
+
+func TestRemainingTimeout(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"timeout": "1m"}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+	if remaining := renesasModule.RemainingTimeout(); remaining != 0 {
+		t.Errorf("Wrong idle remaining timeout: %v", remaining)
+	}
+
+	var remaining time.Duration
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		remaining = renesasModule.RemainingTimeout()
+
+		return 0, true
+	})
+
+	if _, err = renesasModule.GetMasterVersion(); err != nil {
+		t.Fatalf("Can't get master version: %v", err)
+	}
+
+	if remaining <= 0 || remaining > time.Minute {
+		t.Errorf("Wrong remaining timeout: %v", remaining)
+	}
+
+	if remaining := renesasModule.RemainingTimeout(); remaining != 0 {
+		t.Errorf("Wrong idle remaining timeout: %v", remaining)
+	}
+}
+
+func TestUnknownStatusPolicy(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{5: 42}, map[int64][]byte{5: []byte("1.0")})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		policy    string
+		createErr bool
+		errorCode string
+	}
+
+	data := []testData{
+		{errorCode: renesasota.ReasonMasterFailed},
+		{policy: "fail", errorCode: renesasota.ReasonMasterFailed},
+		{policy: "treat-as-success"},
+		{policy: "treat-as-busy-retry", errorCode: renesasota.ReasonMasterBusy},
+		{policy: "ignore", createErr: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Unknown status policy: %d", i)
+
+		options := map[string]interface{}{}
+
+		if item.policy != "" {
+			options["unknownStatusPolicy"] = item.policy
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"), options),
+			&testStateStorage{})
+		if item.createErr {
+			if err == nil {
+				t.Error("Error expected for unsupported policy")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		_, err = module.(*renesasota.RenesasUpdateModule).GetMasterVersion()
+
+		if item.errorCode == "" && err != nil {
+			t.Errorf("Can't get master version: %v", err)
+		}
+
+		if item.errorCode != "" && renesasota.ErrorCode(err) != item.errorCode {
+			t.Errorf("Wrong error: %v", err)
+		}
+
+		if item.errorCode == renesasota.ReasonMasterBusy && !renesasota.IsRetryable(err) {
+			t.Errorf("Error should be retryable: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestGetMasterQueueCapacity(t *testing.T) {
+	type testData struct {
+		status   int64
+		payload  []byte
+		capacity int
+		err      error
+	}
+
+	data := []testData{
+		{payload: []byte{5, 0, 0, 0}, capacity: 5},
+		{payload: []byte{0, 0, 0, 0}, capacity: 0},
+		{status: 3, err: renesasota.ErrUnsupported},
+	}
+
+	for i, item := range data {
+		t.Logf("Queue capacity: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{30: item.status}, map[int64][]byte{30: item.payload})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		capacity, err := module.(*renesasota.RenesasUpdateModule).GetMasterQueueCapacity()
+
+		if item.err == nil && err != nil {
+			t.Errorf("Can't get queue capacity: %v", err)
+		}
+
+		if item.err != nil && !errors.Is(err, item.err) {
+			t.Errorf("Wrong error: %v", err)
+		}
+
+		if capacity != item.capacity {
+			t.Errorf("Wrong queue capacity: %d", capacity)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestGetMasterUptime(t *testing.T) {
+	type testData struct {
+		status    int64
+		payload   []byte
+		uptime    time.Duration
+		elapsed   time.Duration
+		restarted bool
+		err       error
+		errCode   string
+	}
+
+	data := []testData{
+		{payload: []byte{0xdc, 0x05, 0, 0, 0, 0, 0, 0}, uptime: 1500 * time.Millisecond, elapsed: time.Second},
+		{payload: []byte{0xdc, 0x05, 0, 0, 0, 0, 0, 0}, uptime: 1500 * time.Millisecond, elapsed: time.Hour, restarted: true},
+		{payload: []byte{0xdc, 0x05}, errCode: renesasota.ReasonProtocolError},
+		{status: 3, err: renesasota.ErrUnsupported},
+	}
+
+	for i, item := range data {
+		t.Logf("Master uptime: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{8: item.status}, map[int64][]byte{8: item.payload})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		clock := &testClock{now: time.Now()}
+		renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+		renesasModule.SetClock(clock)
+
+		uptime, err := renesasModule.GetMasterUptime()
+
+		if item.err == nil && item.errCode == "" && err != nil {
+			t.Errorf("Can't get master uptime: %v", err)
+		}
+
+		if item.err != nil && !errors.Is(err, item.err) {
+			t.Errorf("Wrong error: %v", err)
+		}
+
+		if item.errCode != "" && renesasota.ErrorCode(err) != item.errCode {
+			t.Errorf("Wrong error code: %v", err)
+		}
+
+		if uptime != item.uptime {
+			t.Errorf("Wrong master uptime: %v", uptime)
+		}
+
+		if err == nil {
+			restarted := false
+
+			log.AddHook(&testLogHook{message: "OTA master restarted", onMessage: func() { restarted = true }})
+
+			clock.now = clock.now.Add(item.elapsed)
+
+			if _, err = renesasModule.GetMasterUptime(); err != nil {
+				t.Errorf("Can't get master uptime: %v", err)
+			}
+
+			log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+			if restarted != item.restarted {
+				t.Errorf("Wrong master restart detection: %v", restarted)
+			}
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestGetMasterConfig(t *testing.T) {
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	type testData struct {
+		status  int64
+		payload string
+		config  map[string]string
+		err     bool
+	}
+
+	data := []testData{
+		{
+			payload: "targetFile=" + targetFile + "\nslots=2\n\nlimit=a=b\n",
+			config:  map[string]string{"targetFile": targetFile, "slots": "2", "limit": "a=b"},
+		},
+		{payload: "targetFile=/dev/other", config: map[string]string{"targetFile": "/dev/other"}},
+		{payload: "", config: map[string]string{}},
+		{payload: "slots", err: true},
+		{status: 3, err: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Master config: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{31: item.status}, map[int64][]byte{31: []byte(item.payload)})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+			map[string]interface{}{"checkMasterConfig": true}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		// Config mismatch or unsupported master doesn't fail init.
+		if err = module.Init(); err != nil {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		config, err := module.(*renesasota.RenesasUpdateModule).GetMasterConfig()
+		if (err != nil) != item.err {
+			t.Errorf("Wrong get master config error: %v", err)
+		}
+
+		if !item.err && !reflect.DeepEqual(config, item.config) {
+			t.Errorf("Wrong master config: %v", config)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		maxRetries int
+		createErr  bool
+	}
+
+	data := []testData{
+		{maxRetries: 0},
+		{maxRetries: 5},
+		{maxRetries: -1, createErr: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Max retries: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"maxRetries": item.maxRetries}), &testStateStorage{})
+		if item.createErr {
+			if err == nil {
+				t.Error("Error expected for wrong max retries")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestInFlightCommand(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+	if command, ok := renesasModule.InFlightCommand(); ok {
+		t.Errorf("Unexpected in flight command: %s", command)
+	}
+
+	var commands []string
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if name, ok := renesasModule.InFlightCommand(); ok {
+			commands = append(commands, name)
+		}
+
+		return 0, true
+	})
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if !reflect.DeepEqual(commands, []string{"syncCompose", "download"}) {
+		t.Errorf("Wrong in flight commands: %v", commands)
+	}
+
+	if command, ok := renesasModule.InFlightCommand(); ok {
+		t.Errorf("Unexpected in flight command: %s", command)
+	}
+}
+
+func TestPreservePreviousSlot(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		preserve bool
+		status   int64
+		commands []int64
+		success  bool
+	}
+
+	data := []testData{
+		{preserve: false, commands: []int64{0, 1}, success: true},
+		{preserve: true, status: 0, commands: []int64{33, 0, 1}, success: true},
+		{preserve: true, status: 3, commands: []int64{33, 0, 1}, success: true},
+		{preserve: true, status: 1, commands: []int64{33}, success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Preserve previous slot: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 33: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"preservePreviousSlot": item.preserve}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); (err == nil) != item.success {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, item.commands) {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestUpdateRebootRequired(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		payload        []byte
+		rebootRequired bool
+	}
+
+	data := []testData{
+		{payload: nil, rebootRequired: false},
+		{payload: []byte{0}, rebootRequired: false},
+		{payload: []byte{1}, rebootRequired: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Reboot required: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0}, map[int64][]byte{3: item.payload})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		rebootRequired, err := module.Update()
+		if err != nil {
+			t.Fatalf("Error update module: %v", err)
+		}
+
+		if rebootRequired != item.rebootRequired {
+			t.Errorf("Wrong reboot required: %v", rebootRequired)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestStateWriteDebounce(t *testing.T) {
+	const (
+		chunkSize    = 4
+		imageContent = "Some image content split into many small chunks"
+	)
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		debounce      string
+		maxWriteCount int
+	}
+
+	data := []testData{
+		{debounce: "0s", maxWriteCount: math.MaxInt32},
+		{debounce: "1h", maxWriteCount: 2},
+	}
+
+	for i, item := range data {
+		t.Logf("State write debounce: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			return 0, true
+		})
+
+		storage := &testStateStorage{}
+		config := moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"uploadChunkSize": chunkSize, "stateWriteDebounce": item.debounce})
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		module.Close()
+
+		if item.debounce == "0s" && storage.writeCount <= len(imageContent)/chunkSize {
+			t.Errorf("Wrong write count: %d", storage.writeCount)
+		}
+
+		if storage.writeCount > item.maxWriteCount {
+			t.Errorf("Wrong write count: %d", storage.writeCount)
+		}
+
+		// State is durable after Prepare returns
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if _, err = module.Update(); err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestConcurrentStateAccess(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		return 0, true
+	})
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+
+			default:
+				if _, err := module.GetVendorVersion(); err != nil {
+					t.Errorf("Error get vendor version: %v", err)
+				}
+
+				renesasModule := module.(*renesasota.RenesasUpdateModule)
+
+				renesasModule.GetPreparedAge()
+				renesasModule.GetLastPhaseTimings()
+				renesasModule.GetProtocolStats()
+				renesasModule.GetLastImagePath()
+				renesasModule.GetUpdateCount()
+				renesasModule.Ready()
+
+				if _, err := renesasModule.StatusJSON(); err != nil {
+					t.Errorf("Error get status JSON: %v", err)
+				}
+			}
+		}
+	}()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Errorf("Error update module: %v", err)
+	}
+
+	close(done)
+	<-stopped
+
+	if version, _ := module.GetVendorVersion(); version != "2.1.0" {
+		t.Errorf("Wrong vendor version: %s", version)
+	}
+}
+
+func TestGetMasterComponentVersions(t *testing.T) {
+	components := func(pairs ...string) []byte {
+		payload := bytes.NewBuffer(nil)
+
+		_ = binary.Write(payload, binary.LittleEndian, uint32(len(pairs)/2))
+
+		for _, value := range pairs {
+			_ = binary.Write(payload, binary.LittleEndian, uint16(len(value)))
+			payload.WriteString(value)
+		}
+
+		return payload.Bytes()
+	}
+
+	type testData struct {
+		statusMap     map[int64]int64
+		payloadMap    map[int64][]byte
+		versions      map[string]string
+		err           error
+		protocolError bool
+		vendorVersion string
+	}
+
+	data := []testData{
+		{
+			statusMap:     map[int64]int64{20: 3, 34: 0},
+			payloadMap:    map[int64][]byte{34: components("test", "2.0.0", "other", "3.0.0")},
+			versions:      map[string]string{"test": "2.0.0", "other": "3.0.0"},
+			vendorVersion: "2.0.0",
+		},
+		{
+			statusMap:     map[int64]int64{20: 3, 34: 0},
+			payloadMap:    map[int64][]byte{34: components("other", "3.0.0")},
+			versions:      map[string]string{"other": "3.0.0"},
+			vendorVersion: "1.0.0",
+		},
+		{
+			statusMap:     map[int64]int64{20: 3, 34: 3, 18: 0},
+			payloadMap:    map[int64][]byte{18: []byte("2.1.0")},
+			versions:      map[string]string{"test": "2.1.0"},
+			vendorVersion: "2.1.0",
+		},
+		{
+			statusMap:     map[int64]int64{20: 3, 34: 3, 18: 3},
+			err:           renesasota.ErrUnsupported,
+			vendorVersion: "1.0.0",
+		},
+		{
+			statusMap:     map[int64]int64{20: 3, 34: 0},
+			payloadMap:    map[int64][]byte{34: components("test", "2.0.0")[:8]},
+			protocolError: true,
+			vendorVersion: "1.0.0",
+		},
+	}
+
+	for i, item := range data {
+		t.Logf("Component versions: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, item.statusMap, item.payloadMap)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")),
+			&testStateStorage{state: []byte(`{"state":0,"vendorVersion":"1.0.0"}`)})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		versions, err := module.(*renesasota.RenesasUpdateModule).GetMasterComponentVersions()
+
+		switch {
+		case item.protocolError:
+			if renesasota.ErrorCode(err) != renesasota.ReasonProtocolError {
+				t.Errorf("Wrong error: %v", err)
+			}
+
+		case !errors.Is(err, item.err):
+			t.Errorf("Wrong error: %v", err)
+
+		case item.err == nil && !reflect.DeepEqual(versions, item.versions):
+			t.Errorf("Wrong component versions: %v", versions)
+		}
+
+		module.Close()
+
+		// Reconcile on init
+
+		if module, err = renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"reconcileOnInit": true}),
+			&testStateStorage{state: []byte(`{"state":0,"vendorVersion":"1.0.0"}`)}); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Init(); err != nil && !item.protocolError {
+			t.Errorf("Error init module: %v", err)
+		}
+
+		if version, _ := module.GetVendorVersion(); version != item.vendorVersion {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestQueueAttributes(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{5: 0},
+		map[int64][]byte{5: []byte("1.0.0")})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		maxMsg  int
+		msgSize int
+		success bool
+	}
+
+	data := []testData{
+		{maxMsg: 0, msgSize: 0, success: true},
+		{maxMsg: 10, msgSize: 8192, success: true},
+		{maxMsg: 10, msgSize: 0, success: false},
+		{maxMsg: 0, msgSize: 8192, success: false},
+		{maxMsg: -1, msgSize: 8192, success: false},
+		{maxMsg: 10, msgSize: -1, success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Queue attributes: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"queueMaxMsg": item.maxMsg, "queueMsgSize": item.msgSize}), &testStateStorage{})
+		if !item.success {
+			if err == nil {
+				t.Error("Error expected")
+
+				module.Close()
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if version, err := module.(*renesasota.RenesasUpdateModule).GetMasterVersion(); err != nil {
+			t.Errorf("Error get master version: %v", err)
+		} else if version != "1.0.0" {
+			t.Errorf("Wrong master version: %s", version)
+		}
+
+		module.Close()
+	}
+}
+
+func TestCreateQueues(t *testing.T) {
+	const (
+		createdSendQueue    = "/ota_created_send_queue"
+		createdReceiveQueue = "/ota_created_receive_queue"
+	)
+
+	for _, createQueues := range []bool{false, true} {
+		t.Logf("Create queues: %v", createQueues)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{
+				"sendQueueName": createdSendQueue, "receiveQueueName": createdReceiveQueue,
+				"createQueues": createQueues,
+			}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		err = module.(*renesasota.RenesasUpdateModule).CheckQueues()
+
+		module.Close()
+
+		if !createQueues {
+			if renesasota.ErrorCode(err) != renesasota.ReasonQueueUnavailable {
+				t.Errorf("Wrong check queues error: %v", err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Error check queues: %v", err)
+		}
+
+		for _, name := range []string{createdSendQueue, createdReceiveQueue} {
+			queue, err := posix_mq.NewMessageQueue(name, posix_mq.O_RDONLY, 0o600, nil)
+			if err != nil {
+				t.Errorf("Queue %s is not created: %v", name, err)
+
+				continue
+			}
+
+			_ = queue.Unlink()
+		}
+	}
+}
+
+func TestPurgeMaster(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		allowPurge bool
+		status     int64
+		device     bool
+		purged     bool
+	}
+
+	data := []testData{
+		{allowPurge: false},
+		{allowPurge: true, status: 1},
+		{allowPurge: true, status: 0, purged: true},
+		{allowPurge: true, status: 0, device: true, purged: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Purge master: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 35: item.status}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		targetFile := filepath.Join(tmpDir, "target.dat")
+
+		if item.device {
+			targetFile = createNullDevice(t, filepath.Join(tmpDir, "device"))
+			defer os.Remove(targetFile)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile,
+			map[string]interface{}{"allowPurge": item.allowPurge}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		if err = module.(*renesasota.RenesasUpdateModule).PurgeMaster(); (err == nil) != item.purged {
+			t.Errorf("Wrong purge error: %v", err)
+		}
+
+		expectedCommands := []int64{35}
+
+		if !item.allowPurge {
+			expectedCommands = nil
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		if _, prepared := module.(*renesasota.RenesasUpdateModule).GetPreparedAge(); prepared == item.purged {
+			t.Errorf("Wrong prepared state: %v", prepared)
+		}
+
+		if _, err = os.Stat(targetFile); os.IsNotExist(err) != (item.purged && !item.device) {
+			t.Errorf("Wrong target file state: %v", err)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestFailedState(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		installStatus  int64
+		activateStatus int64
+		failed         bool
+	}
+
+	data := []testData{
+		{installStatus: 1, activateStatus: 0, failed: false},
+		{installStatus: 0, activateStatus: 1, failed: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Failed state: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: item.installStatus, 3: item.activateStatus, 4: 0}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		storage := &testStateStorage{}
+		config := moduleConfig(filepath.Join(tmpDir, "target.dat"))
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); err == nil {
+			t.Error("Update error expected")
+		}
+
+		module.Close()
+
+		// Restart
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if failed := module.(*renesasota.RenesasUpdateModule).Failed(); failed != item.failed {
+			t.Errorf("Wrong failed state: %v", failed)
+		}
+
+		// Not updated module should be reverted, not applied
+
+		if _, err = module.Apply(); err == nil {
+			t.Error("Apply error expected")
+		}
+
+		if failed := module.(*renesasota.RenesasUpdateModule).Failed(); failed != item.failed {
+			t.Errorf("Wrong failed state after apply: %v", failed)
+		}
+
+		if _, err = module.Revert(); err != nil {
+			t.Errorf("Error revert module: %v", err)
+		}
+
+		if module.(*renesasota.RenesasUpdateModule).Failed() {
+			t.Error("Module is failed after revert")
+		}
+
+		if version, _ := module.GetVendorVersion(); version == "2.1.0" {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestDiagnoseQueues(t *testing.T) {
+	for _, diagnose := range []bool{false, true} {
+		t.Logf("Diagnose queues: %v", diagnose)
+
+		diagnostics := 0
+
+		log.AddHook(&testLogHook{message: "OTA master queue diagnostics", onMessage: func() { diagnostics++ }})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"sendQueueName": "/ota_absent_queue", "diagnoseQueues": diagnose}),
+			&testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Init(); err == nil {
+			t.Error("Init error expected")
+		}
+
+		module.Close()
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		expectedDiagnostics := 0
+
+		if diagnose {
+			expectedDiagnostics = 2
+		}
+
+		if diagnostics != expectedDiagnostics {
+			t.Errorf("Wrong diagnostics count: %d", diagnostics)
+		}
+	}
+}
+
+func TestResumeExtractedImage(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		version         string
+		modifyTarget    bool
+		extractOnResume bool
+	}
+
+	data := []testData{
+		{version: "2.1.0", extractOnResume: false},
+		{version: "2.1.0", modifyTarget: true, extractOnResume: true},
+		{version: "2.2.0", extractOnResume: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Resume extracted image: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 1}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		storage := &testStateStorage{}
+		config := moduleConfig(targetFile)
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+			t.Error("Prepare error expected")
+		}
+
+		module.Close()
+		master.close()
+
+		if item.modifyTarget {
+			if err = ioutil.WriteFile(targetFile, []byte("modified"), 0o600); err != nil {
+				t.Fatalf("Can't modify target file: %v", err)
+			}
+		}
+
+		// Restart
+
+		if master, err = newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil); err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		extracted := false
+
+		log.AddHook(&testLogHook{message: "Image extracted", onMessage: func() { extracted = true }})
+
+		if err = module.Prepare(imageFile, item.version, nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if extracted != item.extractOnResume {
+			t.Errorf("Wrong image extraction: %v", extracted)
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, []int64{0, 1}) {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		content, err := ioutil.ReadFile(targetFile)
+		if err != nil {
+			t.Errorf("Can't read target file: %v", err)
+		}
+
+		if string(content) != "Some image content" {
+			t.Errorf("Wrong target file content: %s", string(content))
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestNegotiateChunkSize(t *testing.T) {
+	const imageContent = "Some image content of 32 bytes.."
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	masterChunkSize := func(size uint32) []byte {
+		payload := bytes.NewBuffer(nil)
+
+		_ = binary.Write(payload, binary.LittleEndian, size)
+
+		return payload.Bytes()
+	}
+
+	type testData struct {
+		negotiate bool
+		status    int64
+		payload   []byte
+		chunks    int
+		success   bool
+	}
+
+	data := []testData{
+		{negotiate: false, chunks: 4, success: true},
+		{negotiate: true, payload: masterChunkSize(4), chunks: 8, success: true},
+		{negotiate: true, payload: masterChunkSize(64), chunks: 4, success: true},
+		{negotiate: true, status: 3, chunks: 4, success: true},
+		{negotiate: true, payload: masterChunkSize(0), success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Negotiate chunk size: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 9: 0, 36: item.status}, map[int64][]byte{36: item.payload})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"uploadChunkSize": 8, "negotiateChunkSize": item.negotiate}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); (err == nil) != item.success {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		chunks := 0
+
+		for _, command := range master.getRecvCommands() {
+			if command == 9 {
+				chunks++
+			}
+		}
+
+		if chunks != item.chunks {
+			t.Errorf("Wrong chunks count: %d", chunks)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestCleanupTargetOnApply(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+	targetFile := filepath.Join(tmpDir, "target.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		options       map[string]interface{}
+		removeTarget  bool
+		targetRemoved bool
+	}
+
+	data := []testData{
+		{options: map[string]interface{}{}, targetRemoved: true},
+		{options: map[string]interface{}{}, removeTarget: true, targetRemoved: true},
+		{options: map[string]interface{}{"cleanupTargetOnApply": false}, targetRemoved: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Cleanup target on apply: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(targetFile, item.options), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); err != nil {
+			t.Fatalf("Error update module: %v", err)
+		}
+
+		if item.removeTarget {
+			if err = os.Remove(targetFile); err != nil {
+				t.Fatalf("Can't remove target file: %v", err)
+			}
+		}
+
+		if _, err = module.Apply(); err != nil {
+			t.Errorf("Error apply module: %v", err)
+		}
+
+		if _, err = os.Stat(targetFile); os.IsNotExist(err) != item.targetRemoved {
+			t.Errorf("Wrong target file state: %v", err)
+		}
+
+		module.Close()
+	}
+}
+
+func TestKeepDeviceTarget(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	targetFile := createNullDevice(t, filepath.Join(tmpDir, "device"))
+	defer os.Remove(targetFile)
+
+	type testData struct {
+		annotations json.RawMessage
+	}
+
+	data := []testData{
+		{annotations: json.RawMessage(`{"sha256":"0000"}`)},
+		{annotations: json.RawMessage(`{"size":1}`)},
+		{annotations: json.RawMessage(fmt.Sprintf(`{"checksums":{"%s":"0000"}}`, targetFile))},
+	}
+
+	for i, item := range data {
+		t.Logf("Keep device target: %d", i)
+
+		module, err := renesasota.New("test", moduleConfig(targetFile), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", item.annotations); renesasota.ErrorCode(err) !=
+			renesasota.ReasonChecksumMismatch {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		module.Close()
+
+		if info, err := os.Stat(targetFile); err != nil || info.Mode()&os.ModeDevice == 0 {
+			t.Fatalf("Device target should not be removed: %v", err)
+		}
+	}
+}
+
+func TestLiveVendorVersion(t *testing.T) {
+	type testData struct {
+		live          bool
+		statusMap     map[int64]int64
+		version       string
+		cachedVersion string
+		err           bool
+	}
+
+	data := []testData{
+		{live: false, statusMap: map[int64]int64{18: 0}, version: "1.0.0", cachedVersion: "1.0.0"},
+		{live: true, statusMap: map[int64]int64{18: 0}, version: "2.0.0", cachedVersion: "2.0.0"},
+		{live: true, statusMap: map[int64]int64{18: 3}, version: "1.0.0", cachedVersion: "1.0.0"},
+		{live: true, statusMap: map[int64]int64{}, version: "1.0.0", cachedVersion: "1.0.0"},
+		{live: true, statusMap: map[int64]int64{18: 1}, cachedVersion: "1.0.0", err: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Live vendor version: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, item.statusMap, map[int64][]byte{18: []byte("2.0.0")})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		storage := &testStateStorage{state: []byte(`{"state":0,"vendorVersion":"1.0.0"}`)}
+		config := moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"liveVendorVersion": item.live, "timeout": "100ms"})
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		version, err := module.GetVendorVersion()
+		if (err != nil) != item.err {
+			t.Errorf("Wrong get vendor version error: %v", err)
+		}
+
+		if version != item.version {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		storage.Lock()
+		writeCount := storage.writeCount
+		storage.Unlock()
+
+		if writeCount != 0 {
+			t.Errorf("State is written by get vendor version: %d", writeCount)
+		}
+
+		module.Close()
+
+		// Cached version after restart
+
+		if module, err = renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if version, _ = module.GetVendorVersion(); version != item.cachedVersion {
+			t.Errorf("Wrong cached vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestConcurrentLiveVendorVersion(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 0, 18: 0}, map[int64][]byte{18: []byte("2.1.0")})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err = createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"liveVendorVersion": true, "stateWriteDebounce": "1m"}),
+		&testStateStorage{state: []byte(`{"state":0,"vendorVersion":"1.0.0"}`)})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	wg.Add(1)
+
+	// Live vendor version is requested while update commands are in flight
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			default:
+			}
+
+			if version, err := module.GetVendorVersion(); err != nil || version != "2.1.0" {
+				t.Errorf("Wrong vendor version: %s, %v", version, err)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		if _, err = module.Update(); err != nil {
+			t.Errorf("Error update module: %v", err)
+		}
+
+		if _, err = module.Revert(); err != nil {
+			t.Errorf("Error revert module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestStatusJSON(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue,
+		map[int64]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 1}, map[int64][]byte{3: {1}})
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	type lastResult struct {
+		Success bool   `json:"success"`
+		Reason  string `json:"reason"`
+	}
+
+	type status struct {
+		SchemaVersion int         `json:"schemaVersion"`
+		ID            string      `json:"id"`
+		State         string      `json:"state"`
+		VendorVersion string      `json:"vendorVersion"`
+		LastResult    *lastResult `json:"lastResult"`
+		RebootPending bool        `json:"rebootPending"`
+		Stats         struct {
+			CommandsSent uint64 `json:"commandsSent"`
+		} `json:"stats"`
+	}
+
+	getStatus := func() (result status) {
+		data, err := module.(*renesasota.RenesasUpdateModule).StatusJSON()
+		if err != nil {
+			t.Fatalf("Can't get status: %v", err)
+		}
+
+		if err = json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("Can't parse status: %v", err)
+		}
+
+		if result.SchemaVersion != 1 || result.ID != "test" {
+			t.Errorf("Wrong status: %s", string(data))
+		}
+
+		return result
+	}
+
+	if result := getStatus(); result.State != "idle" || result.LastResult != nil || result.RebootPending {
+		t.Errorf("Wrong initial status: %v", result)
+	}
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Error prepare module: %v", err)
+	}
+
+	if _, err = module.Update(); err != nil {
+		t.Fatalf("Error update module: %v", err)
+	}
+
+	result := getStatus()
+
+	if result.State != "updated" || result.VendorVersion != "2.1.0" || !result.RebootPending ||
+		result.LastResult == nil || !result.LastResult.Success || result.Stats.CommandsSent == 0 {
+		t.Errorf("Wrong update status: %v", result)
+	}
+
+	if _, err = module.Revert(); err == nil {
+		t.Error("Revert error expected")
+	}
+
+	if result = getStatus(); result.LastResult == nil || result.LastResult.Success ||
+		result.LastResult.Reason != renesasota.ReasonMasterFailed {
+		t.Errorf("Wrong revert status: %v", result)
+	}
+}
+
+func TestMasterDeadline(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	now := time.Now()
+
+	type testData struct {
+		deadline string
+		status   int64
+		commands []int64
+		success  bool
+	}
+
+	data := []testData{
+		{deadline: "0s", commands: []int64{2, 3}, success: true},
+		{deadline: "1h", status: 0, commands: []int64{37, 2, 3}, success: true},
+		{deadline: "1h", status: 3, commands: []int64{37, 2, 3}, success: true},
+		{deadline: "1h", status: 1, commands: []int64{37}, success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Master deadline: %d", i)
+
+		var deadline int64
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command != 37 {
+				return 0, true
+			}
+
+			if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, &deadline); err != nil {
+				t.Errorf("Can't read deadline: %v", err)
+			}
+
+			return item.status, true
+		})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"masterDeadline": item.deadline}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		module.(*renesasota.RenesasUpdateModule).SetClock(&testClock{now: now})
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		master.getRecvCommands()
+
+		if _, err = module.Update(); (err == nil) != item.success {
+			t.Errorf("Wrong update error: %v", err)
+		}
+
+		if commands := master.getRecvCommands(); !reflect.DeepEqual(commands, item.commands) {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		if item.deadline != "0s" && deadline != now.Add(time.Hour).Unix() {
+			t.Errorf("Wrong deadline: %d", deadline)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestVersionScheme(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	type testData struct {
+		scheme  string
+		version string
+		success bool
+	}
+
+	data := []testData{
+		{scheme: "semver", version: "2.1.0", success: true},
+		{scheme: "semver", version: "2.1.0-rc.1+build.5", success: true},
+		{scheme: "semver", version: "2.1", success: false},
+		{scheme: "semver", version: "v2.1.0", success: false},
+		{scheme: "semver", version: "02.1.0", success: false},
+		{scheme: "semver", version: "", success: false},
+		{scheme: "none", version: "R2024-build7", success: true},
+		{scheme: "none", version: "", success: false},
+	}
+
+	for i, item := range data {
+		t.Logf("Version scheme: %d", i)
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"versionScheme": item.scheme}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, item.version, nil); (err == nil) != item.success {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		commands := master.getRecvCommands()
+
+		if !item.success && len(commands) != 0 {
+			t.Errorf("Wrong commands received: %v", commands)
+		}
+
+		module.Close()
+	}
+
+	if _, err = renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+		map[string]interface{}{"versionScheme": "calver"}), &testStateStorage{}); err == nil {
+		t.Error("Error expected for unsupported version scheme")
+	}
+}
+
+func TestRetryPrepareOnDisconnect(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	for _, retry := range []bool{false, true} {
+		t.Logf("Retry prepare on disconnect: %v", retry)
+
+		disconnected := make(chan struct{})
+		once := sync.Once{}
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		// Master "crashes" on download command without response
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command == 1 {
+				once.Do(func() { close(disconnected) })
+
+				return 0, false
+			}
+
+			return 0, true
+		})
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"timeout": "300ms", "retryPrepareOnDisconnect": retry, "queueOpenTimeout": "5s"}),
+			&testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		restarted := make(chan *testOtaMaster, 1)
+
+		go func() {
+			<-disconnected
+
+			master.close()
+
+			// Master restarts after the module detected disconnect
+
+			time.Sleep(time.Second)
+
+			newMaster, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+			if err != nil {
+				t.Errorf("Can't create test OTA master: %v", err)
+			}
+
+			restarted <- newMaster
+		}()
+
+		extracted := 0
+		progressChannel := module.(*renesasota.RenesasUpdateModule).ProgressChannel()
+
+		log.AddHook(&testLogHook{message: "Image extracted", onMessage: func() { extracted++ }})
+
+		err = module.Prepare(imageFile, "2.1.0", nil)
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if (err == nil) != retry {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		// Restarted prepare reports progress to the same channel
+		var lastPhase string
+
+		for event := range progressChannel {
+			lastPhase = event.Phase
+		}
+
+		if (lastPhase == renesasota.ProgressPhaseDone) != retry {
+			t.Errorf("Wrong last progress phase: %s", lastPhase)
+		}
+
+		if err != nil && !errors.Is(err, renesasota.ErrTimeout) {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if extracted != 1 {
+			t.Errorf("Wrong extraction count: %d", extracted)
+		}
+
+		newMaster := <-restarted
+
+		if retry {
+			if commands := newMaster.getRecvCommands(); !reflect.DeepEqual(commands, []int64{0, 1}) {
+				t.Errorf("Wrong commands received: %v", commands)
+			}
+		}
+
+		module.Close()
+
+		if newMaster != nil {
+			newMaster.close()
+		}
+	}
+}
+
+func TestMasterStatusErrors(t *testing.T) {
+	type testData struct {
+		status    int64
+		errorCode string
+		err       error
+		message   string
+	}
+
+	data := []testData{
+		{status: 0},
+		{status: 1, errorCode: renesasota.ReasonMasterFailed, message: "OTA master reported failure"},
+		{status: 2, errorCode: renesasota.ReasonMasterBusy, err: renesasota.ErrBusy},
+		{status: 4, errorCode: renesasota.ReasonChecksumMismatch, err: renesasota.ErrVerificationFailed},
+		{status: 9, errorCode: renesasota.ReasonFlashError, err: renesasota.ErrFlashFailed},
+		{status: 10, errorCode: renesasota.ReasonVersionUnsupported, err: renesasota.ErrVersionUnsupported},
+		{status: 42, errorCode: renesasota.ReasonMasterFailed, message: "unknown status 42"},
+	}
+
+	for i, item := range data {
+		t.Logf("Master status: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{5: item.status},
+			map[int64][]byte{5: []byte("1.0")})
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		_, err = module.(*renesasota.RenesasUpdateModule).GetMasterVersion()
+
+		if item.errorCode == "" && err != nil {
+			t.Errorf("Can't get master version: %v", err)
+		}
+
+		if renesasota.ErrorCode(err) != item.errorCode {
+			t.Errorf("Wrong error code: %v", err)
+		}
+
+		if item.err != nil && !errors.Is(err, item.err) {
+			t.Errorf("Wrong error: %v", err)
+		}
+
+		if item.message != "" && (err == nil || !strings.Contains(err.Error(), item.message)) {
+			t.Errorf("Wrong error message: %v", err)
+		}
+
+		if (item.status == 9 || item.status == 10) && renesasota.IsRetryable(err) {
+			t.Errorf("Error should not be retryable: %v", err)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestCommandMapping(t *testing.T) {
+	names := renesasota.CommandNames()
+	codes := renesasota.CommandCodes()
+
+	if len(names) != len(codes) {
+		t.Fatalf("Wrong mapping size: %d names, %d codes", len(names), len(codes))
+	}
+
+	for command, name := range map[int64]string{0: "syncCompose", 1: "download", 3: "activate", 37: "setDeadline"} {
+		if names[command] != name {
+			t.Errorf("Wrong command %d name: %s", command, names[command])
+		}
+	}
+
+	for name, command := range codes {
+		if names[command] != name {
+			t.Errorf("Mapping mismatch for command %s: %d", name, command)
+		}
+	}
+
+	delete(codes, "download")
+
+	if _, ok := renesasota.CommandCodes()["download"]; !ok {
+		t.Error("Command mapping should not be affected by caller")
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	downloadStatus := int64(1)
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if command == 1 {
+			return downloadStatus, true
+		}
+
+		return 0, true
+	})
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	var events []renesasota.Event
+
+	module.(*renesasota.RenesasUpdateModule).SetEventHandler(func(event renesasota.Event) {
+		events = append(events, event)
+	})
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Error expected")
+	}
+
+	var commandEvents []string
+
+	for _, event := range events {
+		if event.ModuleID != "test" {
+			t.Errorf("Wrong event module ID: %s", event.ModuleID)
+		}
+
+		commandEvents = append(commandEvents, event.Type+":"+event.Command)
+
+		if event.Type == renesasota.EventCommandAcknowledged && (event.Command == "download") != (event.Err != nil) {
+			t.Errorf("Wrong %s command acknowledge error: %v", event.Command, event.Err)
+		}
+	}
+
+	expectedEvents := []string{
+		"commandSent:syncCompose", "commandAcknowledged:syncCompose", "commandSent:download",
+		"commandAcknowledged:download",
+	}
+
+	if !reflect.DeepEqual(commandEvents, expectedEvents) {
+		t.Errorf("Wrong command events: %v", commandEvents)
+	}
+
+	downloadStatus, events = 0, nil
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Prepare error: %v", err)
+	}
+
+	if len(events) == 0 || events[len(events)-1].Type != renesasota.EventStateChanged ||
+		events[len(events)-1].State != "prepared" {
+		t.Errorf("Wrong events: %v", events)
+	}
+
+	module.(*renesasota.RenesasUpdateModule).SetEventHandler(nil)
+
+	events = nil
+
+	if _, err = module.Revert(); err != nil {
+		t.Fatalf("Revert error: %v", err)
+	}
+
+	if len(events) != 0 {
+		t.Errorf("Unexpected events: %v", events)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	type testData struct {
+		targetFiles []string
+		options     map[string]interface{}
+		createErr   bool
+	}
+
+	targetDir := filepath.Join(tmpDir, "targets")
+	imageDir := filepath.Join(tmpDir, "images")
+
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+
+	imageContents := map[string]string{"a.dat": "Image A content", "b.dat": "Image B content"}
+
+	for name, content := range imageContents {
+		if err := createImage(filepath.Join(imageDir, name), content); err != nil {
+			t.Fatalf("Error create image: %v", err)
+		}
+	}
+
+	data := []testData{
+		{targetFiles: []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "slot", "b.dat")}},
+		{
+			targetFiles: []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "slot", "a.dat")},
+			createErr:   true,
+		},
+		{
+			targetFiles: []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "b.dat")},
+			options:     map[string]interface{}{"uploadChunkSize": 4},
+			createErr:   true,
+		},
+	}
+
+	for i, item := range data {
+		t.Logf("Multiple targets: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		var downloads []string
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command == 1 {
+				downloads = append(downloads, string(payload))
+			}
+
+			return 0, true
+		})
+
+		options := map[string]interface{}{"targetFile": item.targetFiles}
+
+		for key, value := range item.options {
+			options[key] = value
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions("", options), &testStateStorage{})
+		if item.createErr {
+			if err == nil {
+				t.Error("Error expected")
+
+				module.Close()
+			}
+
+			master.close()
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(filepath.Join(imageDir, "a.dat"), "2.1.0", nil); err == nil {
+			t.Error("Error expected for image file")
+		}
+
+		if err = module.Prepare(imageDir, "2.1.0", nil); err != nil {
+			t.Errorf("Prepare error: %v", err)
+		}
+
+		for _, targetFile := range item.targetFiles {
+			content, err := ioutil.ReadFile(targetFile)
+			if err != nil {
+				t.Errorf("Can't read target file: %v", err)
+			}
+
+			if string(content) != imageContents[filepath.Base(targetFile)] {
+				t.Errorf("Wrong target file %s content: %s", targetFile, string(content))
+			}
+		}
+
+		if !reflect.DeepEqual(downloads, item.targetFiles) {
+			t.Errorf("Wrong downloaded targets: %v", downloads)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), []int64{0, 1, 1}) {
+			t.Errorf("Wrong commands received: %v", master.getRecvCommands())
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMultipleTargetsFailure(t *testing.T) {
+	targetDir := filepath.Join(tmpDir, "targets")
+	imageDir := filepath.Join(tmpDir, "failed_images")
+	targetFiles := []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "b.dat")}
+
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	if err := createImage(filepath.Join(imageDir, "a.dat"), "Image A content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(imageDir, "b.dat"), []byte("this is not gzip archive"), 0o600); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfigWithOptions("", map[string]interface{}{
+		"targetFile": targetFiles,
+	}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	err = module.Prepare(imageDir, "2.1.0", nil)
+
+	var targetsErr *renesasota.TargetsError
+
+	if !errors.As(err, &targetsErr) {
+		t.Fatalf("Targets error expected: %v", err)
+	}
+
+	if renesasota.ErrorCode(err) != renesasota.ReasonArchiveCorrupted {
+		t.Errorf("Wrong error code: %s", renesasota.ErrorCode(err))
+	}
+
+	if len(targetsErr.Targets) != len(targetFiles) {
+		t.Fatalf("Wrong target statuses: %v", targetsErr.Targets)
+	}
+
+	for i, status := range targetsErr.Targets {
+		if status.File != targetFiles[i] || (status.Err != nil) != (i == 1) {
+			t.Errorf("Wrong target status: %v", status)
+		}
+	}
+
+	for _, targetFile := range targetFiles {
+		if _, err = os.Stat(targetFile); !os.IsNotExist(err) {
+			t.Errorf("Target file %s should be removed: %v", targetFile, err)
+		}
+
+		if _, err = os.Stat(targetFile + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("Temporary target file %s should be removed: %v", targetFile, err)
+		}
+	}
+
+	if commands := master.getRecvCommands(); len(commands) != 0 {
+		t.Errorf("No commands expected: %v", commands)
+	}
+}
+
+func TestMultipleTargetsWriteBudget(t *testing.T) {
+	targetDir := filepath.Join(tmpDir, "targets")
+	imageDir := filepath.Join(tmpDir, "budget_images")
+
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	for name, content := range map[string]string{"a.dat": "Image A content", "b.dat": "Image B content"} {
+		if err := createImage(filepath.Join(imageDir, name), content); err != nil {
+			t.Fatalf("Error create image: %v", err)
+		}
+	}
+
+	type testData struct {
+		budget int
+		err    error
+	}
+
+	data := []testData{
+		{budget: 20, err: renesasota.ErrWriteBudgetExceeded},
+		{budget: 40},
+	}
+
+	for i, item := range data {
+		t.Logf("Multiple targets write budget: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0, 4: 0}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions("", map[string]interface{}{
+			"targetFile":       []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "b.dat")},
+			"dailyWriteBudget": item.budget,
+		}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageDir, "2.1.0", nil); !errors.Is(err, item.err) {
+			t.Errorf("Wrong prepare error: %v", err)
+		}
+
+		if err == nil {
+			if _, err = module.Revert(); err != nil {
+				t.Errorf("Error revert module: %v", err)
+			}
+
+			// Both targets are accounted, so the next prepare exceeds the budget.
+			if err = module.Prepare(imageDir, "2.2.0", nil); !errors.Is(err, renesasota.ErrWriteBudgetExceeded) {
+				t.Errorf("Wrong prepare error: %v", err)
+			}
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMultipleTargetsRetryOnChecksumMismatch(t *testing.T) {
+	const imageContent = "Image B content"
+
+	targetDir := filepath.Join(tmpDir, "targets")
+	imageDir := filepath.Join(tmpDir, "retry_images")
+	targetFiles := []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "b.dat")}
+
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	if err := createImage(filepath.Join(imageDir, "a.dat"), "Image A content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	if err := createImage(filepath.Join(imageDir, "b.dat"), "this is corrupted content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	module, err := renesasota.New("test", moduleConfigWithOptions("", map[string]interface{}{
+		"targetFile": targetFiles, "retryOnChecksumMismatch": 1,
+	}), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	validChecksum := sha256.Sum256([]byte(imageContent))
+	annotations := json.RawMessage(fmt.Sprintf(`{"checksums":{"%s":"%s"}}`,
+		targetFiles[1], hex.EncodeToString(validChecksum[:])))
+	mismatches := 0
+
+	// Simulate transient glitch: the source image is fixed when the first mismatch is detected.
+	log.AddHook(&testLogHook{message: "Extracted image mismatch", onMessage: func() {
+		mismatches++
+
+		if err := createImage(filepath.Join(imageDir, "b.dat"), imageContent); err != nil {
+			t.Errorf("Error create image: %v", err)
+		}
+	}})
+
+	err = module.Prepare(imageDir, "2.1.0", annotations)
+
+	log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if err != nil {
+		t.Errorf("Error prepare module: %v", err)
+	}
+
+	if mismatches != 1 {
+		t.Errorf("Wrong mismatches count: %d", mismatches)
+	}
+
+	content, err := ioutil.ReadFile(targetFiles[1])
+	if err != nil {
+		t.Errorf("Can't read target file: %v", err)
+	}
+
+	if string(content) != imageContent {
+		t.Errorf("Wrong target file content: %s", string(content))
+	}
+}
+
+func TestMultipleTargetsResume(t *testing.T) {
+	targetDir := filepath.Join(tmpDir, "targets")
+	imageDir := filepath.Join(tmpDir, "resume_images")
+	targetFiles := []string{filepath.Join(targetDir, "a.dat"), filepath.Join(targetDir, "b.dat")}
+
+	if err := os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatalf("Can't create image dir: %v", err)
+	}
+	defer os.RemoveAll(imageDir)
+
+	for name, content := range map[string]string{"a.dat": "Image A content", "b.dat": "Image B content"} {
+		if err := createImage(filepath.Join(imageDir, name), content); err != nil {
+			t.Fatalf("Error create image: %v", err)
+		}
+	}
+
+	type testData struct {
+		version         string
+		modifyTarget    bool
+		extractOnResume bool
+	}
+
+	data := []testData{
+		{version: "2.1.0", extractOnResume: false},
+		{version: "2.1.0", modifyTarget: true, extractOnResume: true},
+		{version: "2.2.0", extractOnResume: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Resume multiple targets: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 1}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		storage := &testStateStorage{}
+		config := moduleConfigWithOptions("", map[string]interface{}{"targetFile": targetFiles})
+
+		module, err := renesasota.New("test", config, storage)
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageDir, "2.1.0", nil); err == nil {
+			t.Error("Prepare error expected")
+		}
+
+		module.Close()
+		master.close()
+
+		if item.modifyTarget {
+			if err = ioutil.WriteFile(targetFiles[1], []byte("modified"), 0o600); err != nil {
+				t.Fatalf("Can't modify target file: %v", err)
+			}
+		}
+
+		// Restart
+
+		if master, err = newTestOtaMaster(statusQueue, commandQueue, map[int64]int64{0: 0, 1: 0}, nil); err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		if module, err = renesasota.New("test", config, storage); err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		extracted := 0
+
+		log.AddHook(&testLogHook{message: "Image extracted", onMessage: func() { extracted++ }})
+
+		if err = module.Prepare(imageDir, item.version, nil); err != nil {
+			t.Errorf("Error prepare module: %v", err)
+		}
+
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if (extracted != 0) != item.extractOnResume {
+			t.Errorf("Wrong image extraction: %d", extracted)
+		}
+
+		content, err := ioutil.ReadFile(targetFiles[1])
+		if err != nil {
+			t.Errorf("Can't read target file: %v", err)
+		}
+
+		if string(content) != "Image B content" {
+			t.Errorf("Wrong target file content: %s", string(content))
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestTargetOverride(t *testing.T) {
+	const imageContent = "Some image content"
+
+	type testData struct {
+		annotations string
+		noBaseDir   bool
+		targetFile  string
+		success     bool
+	}
+
+	baseDir := filepath.Join(tmpDir, "slots")
+	outsideDir := filepath.Join(tmpDir, "outside")
+	defaultTarget := filepath.Join(tmpDir, "target.dat")
+
+	for _, dir := range []string{baseDir, outsideDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Can't create dir: %v", err)
+		}
+	}
+
+	if err := os.Symlink(outsideDir, filepath.Join(baseDir, "link")); err != nil && !os.IsExist(err) {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, imageContent); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	data := []testData{
+		{targetFile: defaultTarget, success: true},
+		{annotations: `{"targetFile":"b/target.dat"}`, targetFile: filepath.Join(baseDir, "b", "target.dat"), success: true},
+		{
+			annotations: fmt.Sprintf(`{"targetFile":"%s"}`, filepath.Join(baseDir, "a", "target.dat")),
+			targetFile:  filepath.Join(baseDir, "a", "target.dat"), success: true,
+		},
+		{annotations: `{"slot":"b"}`, targetFile: filepath.Join(tmpDir, "slot_b.dat"), success: true},
+		{annotations: `{"slot":"c"}`},
+		{annotations: `{"targetFile":"../escape.dat"}`},
+		{annotations: `{"targetFile":"b/../../escape.dat"}`},
+		{annotations: `{"targetFile":"/etc/escape.dat"}`},
+		{annotations: `{"targetFile":"link/escape.dat"}`},
+		{annotations: `{"targetFile":"b/target.dat","slot":"b"}`},
+		{annotations: `{"targetFile":"b/target.dat"}`, noBaseDir: true},
+	}
+
+	for i, item := range data {
+		t.Logf("Target override: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		var downloadPayload []byte
+
+		master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+			if command == 1 {
+				downloadPayload = payload
+			}
+
+			return 0, true
+		})
+
+		options := map[string]interface{}{"slotTargetFiles": map[string]string{"b": filepath.Join(tmpDir, "slot_b.dat")}}
+
+		if !item.noBaseDir {
+			options["targetBaseDir"] = baseDir
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(defaultTarget, options), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		var annotations json.RawMessage
+
+		if item.annotations != "" {
+			annotations = json.RawMessage(item.annotations)
+		}
+
+		err = module.Prepare(imageFile, "2.1.0", annotations)
+		if item.success != (err == nil) {
+			t.Errorf("Wrong prepare result: %v", err)
+		}
+
+		if item.success {
+			content, err := ioutil.ReadFile(item.targetFile)
+			if err != nil || string(content) != imageContent {
+				t.Errorf("Wrong target file content: %v", err)
+			}
+
+			expectedPayload := item.targetFile
+
+			if item.annotations == "" {
+				expectedPayload = ""
+			}
+
+			if string(downloadPayload) != expectedPayload {
+				t.Errorf("Wrong download payload: %s", string(downloadPayload))
+			}
+		}
+
+		if _, err = os.Stat(filepath.Join(outsideDir, "escape.dat")); err == nil {
+			t.Error("Target file should not be created outside of base dir")
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	downloadStatus := int64(1)
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if command == 1 {
+			return downloadStatus, true
+		}
+
+		return 0, true
+	})
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Error expected")
+	}
+
+	metrics := newTestMetrics()
+
+	module.(*renesasota.RenesasUpdateModule).SetMetrics(metrics)
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Error expected")
+	}
+
+	downloadStatus = 0
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Prepare error: %v", err)
+	}
+
+	if !reflect.DeepEqual(metrics.sent, map[string]int{"syncCompose": 2, "download": 2}) {
+		t.Errorf("Wrong sent commands: %v", metrics.sent)
+	}
+
+	if !reflect.DeepEqual(metrics.succeeded, map[string]int{"syncCompose": 2, "download": 1}) {
+		t.Errorf("Wrong succeeded commands: %v", metrics.succeeded)
+	}
+
+	if !reflect.DeepEqual(metrics.failed, map[string]int{"download": 1}) {
+		t.Errorf("Wrong failed commands: %v", metrics.failed)
+	}
+
+	if !reflect.DeepEqual(metrics.states, []string{"prepared"}) {
+		t.Errorf("Wrong states: %v", metrics.states)
+	}
+
+	module.(*renesasota.RenesasUpdateModule).SetMetrics(nil)
+
+	if _, err = module.Revert(); err != nil {
+		t.Fatalf("Revert error: %v", err)
+	}
+
+	if !reflect.DeepEqual(metrics.states, []string{"prepared"}) {
+		t.Errorf("Unexpected states: %v", metrics.states)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	downloadStatus := int64(1)
+
+	master.setHandler(func(command int64, payload []byte) (status int64, reply bool) {
+		if command == 1 {
+			return downloadStatus, true
+		}
+
+		return 0, true
+	})
+
+	registry := prometheus.NewRegistry()
+
+	metrics, err := renesasota.NewPrometheusMetrics(registry)
+	if err != nil {
+		t.Fatalf("Can't create Prometheus metrics: %v", err)
+	}
+
+	if _, err = renesasota.NewPrometheusMetrics(registry); err == nil {
+		t.Error("Duplicated metrics registration should fail")
+	}
+
+	module, err := renesasota.New("test", moduleConfig(filepath.Join(tmpDir, "target.dat")), &testStateStorage{})
+	if err != nil {
+		t.Fatalf("Can't create test module: %v", err)
+	}
+	defer module.Close()
+
+	module.(*renesasota.RenesasUpdateModule).SetMetrics(metrics)
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err == nil {
+		t.Error("Error expected")
+	}
+
+	downloadStatus = 0
+
+	if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+		t.Fatalf("Prepare error: %v", err)
+	}
+
+	if _, err = module.Revert(); err != nil {
+		t.Fatalf("Revert error: %v", err)
+	}
+
+	type testData struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}
+
+	data := []testData{
+		{name: "renesasota_commands_sent_total", labels: map[string]string{"command": "download"}, value: 2},
+		{name: "renesasota_commands_succeeded_total", labels: map[string]string{"command": "download"}, value: 1},
+		{name: "renesasota_commands_failed_total", labels: map[string]string{"command": "download"}, value: 1},
+		{name: "renesasota_command_latency_seconds", labels: map[string]string{"command": "download"}, value: 2},
+		{name: "renesasota_state", labels: map[string]string{"state": "prepared"}, value: 0},
+		{name: "renesasota_state", labels: map[string]string{"state": "idle"}, value: 1},
+	}
+
+	for i, item := range data {
+		t.Logf("Metric: %d", i)
+
+		item.labels["module"] = "test"
+
+		if value := gatherMetric(t, registry, item.name, item.labels); value != item.value {
+			t.Errorf("Wrong %s value: %v", item.name, value)
+		}
+	}
+}
+
+func TestRollbackOnPartialFailure(t *testing.T) {
+	imageFile := filepath.Join(tmpDir, "image.dat")
+
+	if err := createImage(imageFile, "Some image content"); err != nil {
+		t.Fatalf("Error create image: %v", err)
+	}
+
+	type testData struct {
+		rollback         bool
+		installStatus    int64
+		revertStatus     int64
+		expectedCommands []int64
+		failed           bool
+	}
+
+	data := []testData{
+		{expectedCommands: []int64{0, 1, 2, 3}, failed: true},
+		{rollback: true, expectedCommands: []int64{0, 1, 2, 3, 4}},
+		{rollback: true, revertStatus: 1, expectedCommands: []int64{0, 1, 2, 3, 4}, failed: true},
+		{rollback: true, installStatus: 1, expectedCommands: []int64{0, 1, 2}},
+	}
+
+	for i, item := range data {
+		t.Logf("Rollback on partial failure: %d", i)
+
+		master, err := newTestOtaMaster(statusQueue, commandQueue,
+			map[int64]int64{0: 0, 1: 0, 2: item.installStatus, 3: 1, 4: item.revertStatus}, nil)
+		if err != nil {
+			t.Fatalf("Can't create test OTA master: %v", err)
+		}
+
+		module, err := renesasota.New("test", moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+			map[string]interface{}{"rollbackOnPartialFailure": item.rollback}), &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+
+		if err = module.Prepare(imageFile, "2.1.0", nil); err != nil {
+			t.Fatalf("Error prepare module: %v", err)
+		}
+
+		if _, err = module.Update(); renesasota.ErrorCode(err) != renesasota.ReasonMasterFailed {
+			t.Errorf("Wrong update error: %v", err)
+		}
+
+		if failed := module.(*renesasota.RenesasUpdateModule).Failed(); failed != item.failed {
+			t.Errorf("Wrong failed state: %v", failed)
+		}
+
+		if !reflect.DeepEqual(master.getRecvCommands(), item.expectedCommands) {
+			t.Errorf("Wrong commands received: %v", master.getRecvCommands())
+		}
+
+		if version, _ := module.GetVendorVersion(); version == "2.1.0" {
+			t.Errorf("Wrong vendor version: %s", version)
+		}
+
+		module.Close()
+		master.close()
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	master, err := newTestOtaMaster(statusQueue, commandQueue, nil, nil)
+	if err != nil {
+		t.Fatalf("Can't create test OTA master: %v", err)
+	}
+	defer master.close()
+
+	var modules []*renesasota.RenesasUpdateModule
+
+	for i := 0; i < 4; i++ {
+		config := moduleConfig(filepath.Join(tmpDir, "target.dat"))
+
+		if i%2 != 0 {
+			config = moduleConfigWithOptions(filepath.Join(tmpDir, "target.dat"),
+				map[string]interface{}{"sendQueueName": "/ota_absent_queue"})
+		}
+
+		module, err := renesasota.New(fmt.Sprintf("test%d", i), config, &testStateStorage{})
+		if err != nil {
+			t.Fatalf("Can't create test module: %v", err)
+		}
+		defer module.Close()
+
+		modules = append(modules, module.(*renesasota.RenesasUpdateModule))
+	}
+
+	results := renesasota.CheckAll(modules, 2)
+
+	if len(results) != len(modules) {
+		t.Fatalf("Wrong results count: %d", len(results))
+	}
+
+	for i, module := range modules {
+		err := results[module.GetID()]
+
+		if i%2 == 0 && err != nil {
+			t.Errorf("Check queues error: %v", err)
+		}
+
+		if i%2 != 0 && renesasota.ErrorCode(err) != renesasota.ReasonQueueUnavailable {
+			t.Errorf("Wrong check queues result: %v", err)
+		}
+	}
+}
+
+/***********************************************************************************************************************
+ * testOtaMaster
+ **********************************************************************************************************************/
+
+func newTestOtaMaster(
+	sendQueue, receiveQueue string, statusMap map[int64]int64, payloadMap map[int64][]byte,
+) (master *testOtaMaster, err error) {
+	localMaster := &testOtaMaster{
+		statusMap:   statusMap,
+		payloadMap:  payloadMap,
+		stopChannel: make(chan struct{}),
+		byteOrder:   binary.LittleEndian,
+	}
+
+	defer func() {
+		if err != nil {
+			localMaster.close()
+		}
+	}()
+
+	if localMaster.sendMQ, err = posix_mq.NewMessageQueue(
+		sendQueue, posix_mq.O_CREAT|posix_mq.O_WRONLY, 0o600, nil); err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	if localMaster.recvMQ, err = posix_mq.NewMessageQueue(
+		receiveQueue, posix_mq.O_CREAT|posix_mq.O_RDONLY, 0o600, nil); err != nil {
+		return nil, aoserrors.Wrap(err)
+	}
+
+	localMaster.wg.Add(1)
+
+	go func() {
+		defer localMaster.wg.Done()
+
+		for {
+			select {
+			case <-localMaster.stopChannel:
+				return
+
+			default:
+			}
+
+			data, _, err := localMaster.recvMQ.TimedReceive(time.Now().Add(masterPollInterval))
+			if err != nil {
+				if errors.Is(err, syscall.ETIMEDOUT) {
+					continue
+				}
+
+				log.Errorf("Receive message error: %v", err)
+
+				return
+			}
+
+			buffer := bytes.NewBuffer(data)
+
+			localMaster.Lock()
+			byteOrder := localMaster.byteOrder
+			localMaster.Unlock()
+
+			var command int64
+
+			if err = binary.Read(buffer, byteOrder, &command); err != nil {
+				log.Errorf("Read message error: %v", err)
+			}
+
+			localMaster.Lock()
+			localMaster.recvCommands = append(localMaster.recvCommands, command)
+			handler := localMaster.handler
+			localMaster.Unlock()
+
+			status, ok := localMaster.statusMap[command]
+
+			if handler != nil {
+				status, ok = handler(command, buffer.Bytes())
+			}
+
+			if !ok {
+				continue
+			}
+
+			buffer = bytes.NewBuffer(nil)
+
+			if err = binary.Write(buffer, byteOrder, status); err != nil {
+				log.Errorf("Write message error: %v", err)
+			}
+
+			buffer.Write(localMaster.payloadMap[command])
+
+			if err = localMaster.sendMQ.Send(buffer.Bytes(), 0); err != nil {
+				log.Errorf("Send message error: %v", err)
+			}
+		}
+	}()
+
+	return localMaster, nil
+}
+
+func (master *testOtaMaster) getRecvCommands() []int64 {
+	master.Lock()
+	defer master.Unlock()
+
+	recvCommands := master.recvCommands
+
+	master.recvCommands = nil
+
+	return recvCommands
+}
+
+func (master *testOtaMaster) setHandler(handler requestHandler) {
+	master.Lock()
+	defer master.Unlock()
+
+	master.handler = handler
+}
+
+func (master *testOtaMaster) setByteOrder(byteOrder binary.ByteOrder) {
+	master.Lock()
+	defer master.Unlock()
+
+	master.byteOrder = byteOrder
+}
+
+func (master *testOtaMaster) close() {
+	close(master.stopChannel)
+	master.wg.Wait()
+
+	if master.recvMQ != nil {
+		_ = master.recvMQ.Unlink()
+	}
+
+	if master.sendMQ != nil {
+		_ = master.sendMQ.Unlink()
+	}
+}
+
+/***********************************************************************************************************************
+ * testStateStorage
+ **********************************************************************************************************************/
+
+func (hook *testLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (hook *testLogHook) Fire(entry *log.Entry) error {
+	if strings.Contains(entry.Message, hook.message) {
+		hook.onMessage()
+	}
+
+	return nil
+}
+
+func (storage *testStateStorage) GetModuleState(id string) (state []byte, err error) {
+	storage.Lock()
+	defer storage.Unlock()
+
+	if len(storage.getErrors) > 0 {
+		err, storage.getErrors = storage.getErrors[0], storage.getErrors[1:]
+
+		return nil, err
+	}
+
+	return storage.state, nil
+}
+
+func (storage *testStateStorage) SetModuleState(id string, state []byte) (err error) {
+	storage.Lock()
+	defer storage.Unlock()
+
+	storage.state = state
+	storage.writeCount++
+
+	return nil
+}
+
+/***********************************************************************************************************************
+ * testClock
+ **********************************************************************************************************************/
+
+func (clock *testClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.now
+}
+
+func (clock *testClock) After(d time.Duration) <-chan time.Time {
+	channel := make(chan time.Time, 1)
+
+	channel <- clock.Now().Add(d)
+
+	return channel
+}
+
+func (clock *testClock) set(now time.Time) {
+	clock.Lock()
+	defer clock.Unlock()
+
+	clock.now = now
+}
+
+/***********************************************************************************************************************
+ * testMetrics
+ **********************************************************************************************************************/
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{sent: make(map[string]int), succeeded: make(map[string]int), failed: make(map[string]int)}
+}
+
+func (metrics *testMetrics) CommandSent(moduleID, command string) {
+	metrics.sent[command]++
+}
+
+func (metrics *testMetrics) CommandSucceeded(moduleID, command string, latency time.Duration) {
+	metrics.succeeded[command]++
+}
+
+func (metrics *testMetrics) CommandFailed(moduleID, command string, latency time.Duration) {
+	metrics.failed[command]++
+}
+
+func (metrics *testMetrics) StateChanged(moduleID, state string) {
+	metrics.states = append(metrics.states, state)
+}
+
+/***********************************************************************************************************************
+ * Private
+ **********************************************************************************************************************/
+
+func moduleConfig(targetFile string) json.RawMessage {
+	return json.RawMessage(
+		fmt.Sprintf(`{"sendQueueName":"%s","receiveQueueName":"%s","timeout":"%s","targetFile":"%s"}`,
+			commandQueue, statusQueue, queueTimeout.String(), targetFile))
+}
+
+func moduleConfigWithOptions(targetFile string, options map[string]interface{}) json.RawMessage {
+	config := map[string]interface{}{}
+
+	if err := json.Unmarshal(moduleConfig(targetFile), &config); err != nil {
+		log.Fatalf("Can't unmarshal module config: %v", err)
+	}
+
+	for key, value := range options {
+		config[key] = value
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		log.Fatalf("Can't marshal module config: %v", err)
+	}
+
+	return data
+}
+
+// gatherMetric returns value of counter or gauge, or sample count of histogram, with the given labels.
+func gatherMetric(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metricLoop:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metricLoop
+				}
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+
+			case metric.GetGauge() != nil:
+				return metric.GetGauge().GetValue()
+
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	t.Fatalf("Metric %s %v not found", name, labels)
+
+	return 0
+}
+
+// createNullDevice creates character device node with numbers of /dev/null to be used as not regular target file.
+func createNullDevice(t *testing.T, path string) string {
+	t.Helper()
+
+	_ = os.Remove(path)
+
+	if err := syscall.Mknod(path, syscall.S_IFCHR|0o666, 1<<8|3); err != nil {
+		t.Skipf("Can't create device node: %v", err)
+	}
+
+	return path
+}
+
+func countOpenFiles(t *testing.T) int {
+	t.Helper()
+
+	files, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("Can't read open files: %v", err)
+	}
+
+	return len(files)
+}
+
+func uint64Payload(value uint64) []byte {
+	buffer := bytes.NewBuffer(nil)
+
+	_ = binary.Write(buffer, binary.LittleEndian, value)
+
+	return buffer.Bytes()
+}
+
+func createZstdImage(imageFile, content string) error {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return aoserrors.Wrap(err)
+	}
+	defer encoder.Close()
+
+	if err = ioutil.WriteFile(imageFile, encoder.EncodeAll([]byte(content), nil), 0o600); err != nil {
+		return aoserrors.Wrap(err)
+	}
+
+	return nil
 }
 
 func createImage(imageFile, content string) error {